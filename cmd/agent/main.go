@@ -1,19 +1,62 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
 	"github.com/paranoiachains/metrics/internal/collector"
-	"github.com/paranoiachains/metrics/internal/flags"
+	"github.com/paranoiachains/metrics/internal/config"
 )
 
 func main() {
-	flags.ParseAgentFlags()
-	flags.ParseEnv()
-	if flags.Cfg.Address != "" {
-		flags.ClientEndpoint = flags.Cfg.Address
+	cfg, err := config.LoadAgent(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		os.Exit(2)
 	}
+	fmt.Println("config:", cfg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 
-	go collector.UpdateWithInterval(flags.PollInterval)
-	go collector.SendWithInterval(flags.ReportInterval, flags.ClientEndpoint)
+	cfgs := config.NewAgentStore(cfg, os.Args[1:])
+	go cfgs.WatchSIGHUP(ctx, func(result config.ReloadResult) {
+		if !result.OK {
+			fmt.Println("config reload failed:", result.Error)
+			return
+		}
+		fmt.Println("config reloaded, applied:", result.Applied, "restart required:", result.RestartRequired)
+		fmt.Println("config:", cfgs.Get())
+	})
 
-	select {}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		collector.UpdateWithInterval(ctx, func() int { return cfgs.Get().PollInterval })
+	}()
+	go func() {
+		defer wg.Done()
+		collector.SendWithInterval(ctx, cfgs)
+	}()
+
+	<-ctx.Done()
+	wg.Wait()
+
+	// final send of whatever was collected since the last report
+	if err := collector.Send(cfgs.Get()); err != nil {
+		fmt.Println("final send failed: ", err)
+	} else {
+		fmt.Println("Metrics sent!")
+	}
+	collector.CloseWS()
 }
@@ -1,79 +1,64 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/gin-gonic/gin"
-	"github.com/paranoiachains/metrics/internal/flags"
-	"github.com/paranoiachains/metrics/internal/handlers"
+	"github.com/paranoiachains/metrics/internal/config"
 	"github.com/paranoiachains/metrics/internal/logger"
-	"github.com/paranoiachains/metrics/internal/middleware"
-	"github.com/paranoiachains/metrics/internal/storage"
+	"github.com/paranoiachains/metrics/internal/server"
 	"go.uber.org/zap"
 )
 
-var CurrentStorage storage.Database
-
 func main() {
 	logger.Initialize()
 
-	flags.ParseServerFlags()
-	flags.ParseEnv()
-	fmt.Println("restore env: ", flags.Cfg.Restore, "restore r:", flags.Restore)
-
-	logger.Log.Info("flags",
-		zap.Bool("Restore?", flags.Restore),
-		zap.String("Path", flags.FileStoragePath),
-		zap.Int("Store interval", flags.StoreInterval),
-		zap.String("DB endpoint", flags.DBEndpoint),
-		zap.Bool("Key provided", flags.ServerKey != ""),
-	)
-
-	db, err := storage.DetermineStorage()
+	cfg, err := config.LoadServer(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		os.Exit(2)
+	}
+	if err := logger.SetLevel(cfg.LogLevel); err != nil {
 		logger.Log.Error("error", zap.Error(err))
-		return
 	}
-	storage.CurrentStorage = db
+	logger.Log.Info("config", zap.Stringer("effective", cfg))
 
-	// JSON file storage
-	if flags.DBEndpoint == "" {
-		os.Mkdir("tmp", 0666)
-		if !flags.Restore {
-			storage.Storage.Clear()
-			_, err := os.Create(flags.FileStoragePath)
-			if err != nil {
-				logger.Log.Error("error", zap.Error(err))
-			}
-		} else {
-			storage.Storage.Restore(flags.FileStoragePath)
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
 
-		go storage.WriteWithInterval(storage.Storage, flags.FileStoragePath, flags.StoreInterval)
+	// settings that may change on SIGHUP are read from cfgs
+	cfgs := config.NewServerStore(cfg, os.Args[1:])
+	cfgs.OnApply(func(next *config.Server) {
+		if err := logger.SetLevel(next.LogLevel); err != nil {
+			logger.Log.Error("error", zap.Error(err))
+		}
+	})
+	go cfgs.WatchSIGHUP(ctx, func(result config.ReloadResult) {
+		if !result.OK {
+			logger.Log.Error("config reload failed", zap.String("error", result.Error))
+			return
+		}
+		logger.Log.Info("config reloaded",
+			zap.Strings("applied", result.Applied),
+			zap.Strings("restart required", result.RestartRequired),
+			zap.Stringer("effective", cfgs.Get()),
+		)
+	})
+
+	srv, err := server.NewServer(server.WithConfigStore(cfgs), server.WithLogger(logger.Log))
+	if err != nil {
+		logger.Log.Error("error", zap.Error(err))
+		return
 	}
-
-	if flags.Cfg.Address != "" {
-		flags.ServerEndpoint = flags.Cfg.Address
+	if err := srv.Run(ctx); err != nil {
+		logger.Log.Error("server error", zap.Error(err))
 	}
-
-	r := gin.New()
-	r.Use(gin.Recovery(), middleware.LoggerMiddleware(), middleware.GzipMiddleware(), middleware.Hash())
-
-	// HTML response
-	r.GET("/", handlers.HTMLReturnAll)
-
-	// Ping Database
-	r.GET("/ping", handlers.Ping)
-
-	// JSON requests
-	r.POST("/update/", handlers.JSONUpdate())
-	r.POST("/updates/", handlers.JSONBatch())
-	r.POST("/value/", handlers.JSONValue())
-
-	// casual url requests
-	r.POST("/update/:metricType/:metricName/:metricValue", handlers.URLUpdate())
-	r.GET("/value/:metricType/:metricName/", handlers.URLValue)
-
-	r.Run(flags.ServerEndpoint)
 }
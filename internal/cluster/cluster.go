@@ -0,0 +1,440 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// endpoints nodes call on each other, they act on the owner's own storage and are never forwarded again
+const (
+	UpdatesPath = "/cluster/updates/"
+	ValuePath   = "/cluster/value/"
+	HandoffPath = "/cluster/handoff/"
+)
+
+// HandoffHeader carries the id of a handoff, the receiver adopts each id once
+const HandoffHeader = "X-Handoff-Id"
+
+// ErrRebalanceUnsupported is returned for backends that cannot list and take series
+var ErrRebalanceUnsupported = errors.New("storage cannot hand series to other nodes")
+
+// ErrSnapshotUnsupported is returned by Export and Import, a node holds only the series it owns
+var ErrSnapshotUnsupported = fmt.Errorf("%w in cluster mode, every node holds only its own series", storage.ErrSnapshotUnsupported)
+
+// how often series that reached the wrong node are moved even without membership changes
+const rebalanceInterval = time.Minute
+
+// time a forwarded request may take
+const requestTimeout = 5 * time.Second
+
+// Members returns the current node urls
+type Members func() ([]string, error)
+
+type Config struct {
+	Self     string        // url other nodes reach this one at, as written in the member list
+	Replicas int           // ring points per node, DefaultReplicas if 0
+	Key      func() string // signs forwarded bodies like an agent does, nil or empty disables signing
+	Client   *http.Client  // http.DefaultClient with a timeout if nil
+}
+
+// Cluster is the storage of one node. series owned by other nodes are written
+// to and read from their owners, everything else goes to the local storage.
+// the server's own series are always local.
+// snapshots are refused rather than taken of the local share only, so admin
+// snapshot, backup and restore are not available in cluster mode
+type Cluster struct {
+	storage.Database
+	self     string
+	replicas int
+	key      func() string
+	client   *http.Client
+	ring     atomic.Pointer[Ring]
+	mu       sync.Mutex // one rebalance at a time, guards pending
+	pending  []handoff  // sent but not known to be adopted and taken
+}
+
+// series sent to another node in one request
+type handoff struct {
+	id      string
+	owner   string
+	metrics collector.Metrics
+}
+
+func New(local storage.Database, cfg Config) *Cluster {
+	c := &Cluster{
+		Database: local,
+		self:     normalize(cfg.Self),
+		replicas: cfg.Replicas,
+		key:      cfg.Key,
+		client:   cfg.Client,
+	}
+	if c.key == nil {
+		c.key = func() string { return "" }
+	}
+	if c.client == nil {
+		c.client = &http.Client{Timeout: requestTimeout}
+	}
+	c.ring.Store(NewRing(nil, c.replicas))
+	return c
+}
+
+// Unwrap returns the local storage
+func (c *Cluster) Unwrap() storage.Database {
+	return c.Database
+}
+
+func (c *Cluster) Self() string {
+	return c.self
+}
+
+func (c *Cluster) Ring() *Ring {
+	return c.ring.Load()
+}
+
+// SetMembers replaces the ring and reports whether membership changed
+func (c *Cluster) SetMembers(nodes []string) bool {
+	next := NewRing(nodes, c.replicas)
+	if slices.Equal(next.nodes, c.ring.Load().nodes) {
+		return false
+	}
+	c.ring.Store(next)
+	return true
+}
+
+// Owner returns the node id belongs to
+func (c *Cluster) Owner(id string) string {
+	if selfstats.Reserved(id) {
+		return c.self
+	}
+	if owner := c.ring.Load().Owner(id); owner != "" {
+		return owner
+	}
+	return c.self
+}
+
+func (c *Cluster) Update(ctx context.Context, mtype string, id string, value any) error {
+	owner := c.Owner(id)
+	if owner == c.self {
+		return c.Database.Update(ctx, mtype, id, value)
+	}
+	metric := collector.Metric{ID: id, MType: mtype}
+	switch v := value.(type) {
+	case float64:
+		metric.Value = &v
+	case int64:
+		metric.Delta = &v
+	default:
+		return fmt.Errorf("type assertion error while forwarding %s metric", mtype)
+	}
+	return c.forward(ctx, owner, collector.Metrics{metric})
+}
+
+// UpdateBatch writes the local part and forwards the rest to their owners concurrently.
+// parts that succeeded stay written when another one fails
+func (c *Cluster) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	parts := make(map[string]collector.Metrics)
+	for _, metric := range metrics {
+		owner := c.Owner(metric.ID)
+		parts[owner] = append(parts[owner], metric)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 0, len(parts))
+	var mu sync.Mutex
+	for owner, part := range parts {
+		if owner == c.self {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.forward(ctx, owner, part); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	if local, ok := parts[c.self]; ok {
+		if err := c.Database.UpdateBatch(ctx, local); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (c *Cluster) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	owner := c.Owner(id)
+	if owner == c.self {
+		return c.Database.Return(ctx, mtype, id)
+	}
+	return c.fetch(ctx, owner, mtype, id)
+}
+
+// Export refuses, a snapshot of the local storage would miss every other node's series
+func (c *Cluster) Export(ctx context.Context) (collector.Metrics, error) {
+	return nil, ErrSnapshotUnsupported
+}
+
+// Import refuses, replace would only clear the local share and series
+// owned by other nodes would be stored on the wrong one
+func (c *Cluster) Import(ctx context.Context, metrics collector.Metrics, replace bool) error {
+	return ErrSnapshotUnsupported
+}
+
+func (c *Cluster) forward(ctx context.Context, node string, metrics collector.Metrics) error {
+	if err := c.post(ctx, node, UpdatesPath, "", metrics); err != nil {
+		selfstats.FromContext(ctx).Inc("cluster.forward_errors", 1)
+		return err
+	}
+	selfstats.FromContext(ctx).Inc("cluster.forwarded", int64(len(metrics)))
+	return nil
+}
+
+// post sends metrics to node, handoff is the id of a handoff if not empty
+func (c *Cluster) post(ctx context.Context, node, path, handoff string, metrics collector.Metrics) error {
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, node+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if handoff != "" {
+		req.Header.Set(HandoffHeader, handoff)
+	}
+	if key := c.key(); key != "" {
+		h := hmac.New(sha256.New, []byte(key))
+		h.Write(body)
+		req.Header.Set("HashSHA256", hex.EncodeToString(h.Sum(nil)))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("forwarding to %s: %w", node, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("forwarding to %s: %s", node, resp.Status)
+	}
+	return nil
+}
+
+func (c *Cluster) fetch(ctx context.Context, node, mtype, id string) (*collector.Metric, error) {
+	u := node + ValuePath + url.PathEscape(mtype) + "/" + url.PathEscape(id) + "/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", node, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("no such %s metric", mtype)
+	default:
+		return nil, fmt.Errorf("reading from %s: %s", node, resp.Status)
+	}
+	var metric collector.Metric
+	if err := json.NewDecoder(resp.Body).Decode(&metric); err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", node, err)
+	}
+	return &metric, nil
+}
+
+// Rebalance hands local series owned by other nodes to them and takes them out here,
+// it returns how many moved. a node missing from the member list hands off everything.
+// only the handed off values are taken, so writes that land meanwhile stay here and
+// move with the next rebalance. a handoff that may have reached its owner is resent
+// with the same id until it is confirmed, the owner adopts every id once
+func (c *Cluster) Rebalance(ctx context.Context) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	local := storage.Unwrap(c.Database)
+	snap, ok := local.(storage.Snapshotter)
+	taker, ok2 := local.(storage.Taker)
+	if !ok || !ok2 {
+		return 0, ErrRebalanceUnsupported
+	}
+
+	moved := 0
+	var errs []error
+	pending := c.pending
+	c.pending = nil
+	for _, h := range pending {
+		n, err := c.handoff(ctx, taker, h)
+		moved += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// series of unconfirmed handoffs wait for them, sending them again under
+	// a new id could add counters twice
+	held := make(map[string]bool)
+	for _, h := range c.pending {
+		for _, metric := range h.metrics {
+			held[metric.MType+"/"+metric.ID] = true
+		}
+	}
+
+	metrics, err := snap.Export(ctx)
+	if err != nil {
+		return moved, errors.Join(append(errs, err)...)
+	}
+	leaving := make(map[string]collector.Metrics)
+	for _, metric := range metrics {
+		if owner := c.Owner(metric.ID); owner != c.self && !held[metric.MType+"/"+metric.ID] {
+			leaving[owner] = append(leaving[owner], metric)
+		}
+	}
+	for owner, part := range leaving {
+		n, err := c.handoff(ctx, taker, handoff{id: newHandoffID(), owner: owner, metrics: part})
+		moved += n
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	selfstats.FromContext(ctx).Inc("cluster.handed_off", int64(moved))
+	return moved, errors.Join(errs...)
+}
+
+// handoff sends h to its owner and takes its series out of local storage,
+// h stays pending if either step fails
+func (c *Cluster) handoff(ctx context.Context, taker storage.Taker, h handoff) (int, error) {
+	if err := c.post(ctx, h.owner, HandoffPath, h.id, h.metrics); err != nil {
+		c.pending = append(c.pending, h)
+		return 0, err
+	}
+	if err := taker.Take(ctx, h.metrics); err != nil {
+		c.pending = append(c.pending, h)
+		return 0, err
+	}
+	return len(h.metrics), nil
+}
+
+func newHandoffID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Adopt stores series handed off by another node. counters are added to what
+// this node already has, gauges are only set if this node has none, since a
+// newer value may have arrived since the ring changed
+func Adopt(ctx context.Context, db storage.Database, metrics collector.Metrics) error {
+	var adopted collector.Metrics
+	for _, metric := range metrics {
+		if metric.MType == "gauge" {
+			if _, err := db.Return(ctx, metric.MType, metric.ID); err == nil {
+				continue
+			}
+		}
+		adopted = append(adopted, metric)
+	}
+	if len(adopted) == 0 {
+		return nil
+	}
+	return db.UpdateBatch(ctx, adopted)
+}
+
+// handoff ids are remembered far longer than a node keeps resending one
+const handoffTTL = time.Hour
+
+// Handoffs adopts each handoff once, a resent one is acknowledged without adding its counters again
+type Handoffs struct {
+	mu   sync.Mutex // held while adopting, so a resend waits for the first attempt
+	seen map[string]time.Time
+}
+
+func NewHandoffs() *Handoffs {
+	return &Handoffs{seen: make(map[string]time.Time)}
+}
+
+// Adopt is the package Adopt for handoff id and reports false if id was adopted before.
+// an empty id is adopted every time
+func (h *Handoffs) Adopt(ctx context.Context, db storage.Database, id string, metrics collector.Metrics) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for seen, at := range h.seen {
+		if now.Sub(at) > handoffTTL {
+			delete(h.seen, seen)
+		}
+	}
+	if _, ok := h.seen[id]; ok {
+		return false, nil
+	}
+	if err := Adopt(ctx, db, metrics); err != nil {
+		return false, err
+	}
+	if id != "" {
+		h.seen[id] = now
+	}
+	return true, nil
+}
+
+// Run keeps membership current and rebalances when it changes, or every
+// rebalanceInterval for series that reached this node while members disagreed
+func (c *Cluster) Run(ctx context.Context, members Members, refresh time.Duration) {
+	sweep := time.NewTicker(rebalanceInterval)
+	defer sweep.Stop()
+	rebalance := true // series may have moved while this node was down
+	log := logger.FromContext(ctx)
+	for {
+		nodes, err := members()
+		if err != nil {
+			log.Warn("reading cluster members", zap.Error(err))
+		} else if c.SetMembers(nodes) {
+			log.Info("cluster members changed", zap.Strings("nodes", c.Ring().Nodes()))
+			rebalance = true
+		}
+		if rebalance {
+			moved, err := c.Rebalance(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Error("error while rebalancing series", zap.Error(err))
+			}
+			if moved > 0 {
+				log.Info("handed off series", zap.Int("series", moved))
+			}
+			rebalance = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-sweep.C:
+			rebalance = true
+		case <-time.After(refresh):
+		}
+	}
+}
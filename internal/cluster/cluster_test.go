@@ -0,0 +1,235 @@
+package cluster
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterForwards(t *testing.T) {
+	ctx := context.Background()
+	var received collector.Metrics
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case UpdatesPath:
+			h := hmac.New(sha256.New, []byte("secret"))
+			h.Write(body)
+			assert.Equal(t, hex.EncodeToString(h.Sum(nil)), r.Header.Get("HashSHA256"), "forwarded bodies are signed")
+			var metrics collector.Metrics
+			require.NoError(t, json.Unmarshal(body, &metrics))
+			received = append(received, metrics...)
+		case ValuePath + "gauge/remote/":
+			w.Write([]byte(`{"id":"remote","type":"gauge","value":2.5}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	local := storage.NewMemStorage()
+	c := New(local, Config{Self: "http://self", Key: func() string { return "secret" }})
+	c.SetMembers([]string{remote.URL})
+	assert.Equal(t, "http://self", c.Owner("_server.http.requests"), "own stats stay local")
+
+	require.NoError(t, c.Update(ctx, "counter", "requests", int64(3)))
+	one := 1.0
+	require.NoError(t, c.UpdateBatch(ctx, collector.Metrics{
+		{ID: "load", MType: "gauge", Value: &one},
+		{ID: "_server.up", MType: "gauge", Value: &one},
+	}))
+	require.Len(t, received, 2)
+	assert.Equal(t, "requests", received[0].ID)
+	assert.Equal(t, "load", received[1].ID)
+	_, err := local.Return(ctx, "gauge", "_server.up")
+	assert.NoError(t, err)
+
+	m, err := c.Return(ctx, "gauge", "remote")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, *m.Value)
+	_, err = c.Return(ctx, "gauge", "missing")
+	assert.ErrorContains(t, err, "no such gauge metric")
+
+	remote.Close()
+	assert.Error(t, c.Update(ctx, "counter", "requests", int64(1)))
+}
+
+func TestAdopt(t *testing.T) {
+	ctx := context.Background()
+	db := storage.NewMemStorage()
+	require.NoError(t, db.Update(ctx, "gauge", "load", 9.0))
+	require.NoError(t, db.Update(ctx, "counter", "requests", int64(2)))
+
+	old, d := 1.0, int64(5)
+	require.NoError(t, Adopt(ctx, db, collector.Metrics{
+		{ID: "load", MType: "gauge", Value: &old},
+		{ID: "requests", MType: "counter", Delta: &d},
+		{ID: "new", MType: "gauge", Value: &old},
+	}))
+	m, _ := db.Return(ctx, "gauge", "load")
+	assert.Equal(t, 9.0, *m.Value, "newer gauge is kept")
+	m, _ = db.Return(ctx, "counter", "requests")
+	assert.Equal(t, int64(7), *m.Delta, "counters add up")
+	m, _ = db.Return(ctx, "gauge", "new")
+	assert.Equal(t, 1.0, *m.Value)
+}
+
+// a node adopting handoffs into db, respond runs after each adoption and returns the status sent back
+func adoptingNode(t *testing.T, db storage.Database, respond func(id string) int) *httptest.Server {
+	handoffs := NewHandoffs()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics collector.Metrics
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&metrics)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id := r.Header.Get(HandoffHeader)
+		if _, err := handoffs.Adopt(r.Context(), db, id, metrics); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(respond(id))
+	}))
+}
+
+func counter(t *testing.T, db storage.Database, id string) int64 {
+	m, err := db.Return(context.Background(), "counter", id)
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func TestRebalanceKeepsConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	local, remote := storage.NewMemStorage(), storage.NewMemStorage()
+	require.NoError(t, local.Update(ctx, "counter", "requests", int64(10)))
+	require.NoError(t, local.Update(ctx, "gauge", "load", 1.0))
+
+	// writes that reach the old owner while its handoff is on the way
+	var once sync.Once
+	node := adoptingNode(t, remote, func(string) int {
+		once.Do(func() {
+			assert.NoError(t, local.Update(ctx, "counter", "requests", int64(5)))
+			assert.NoError(t, local.Update(ctx, "gauge", "load", 2.0))
+		})
+		return http.StatusOK
+	})
+	defer node.Close()
+	c := New(local, Config{Self: "http://self"})
+	c.SetMembers([]string{node.URL})
+
+	moved, err := c.Rebalance(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	assert.Equal(t, int64(10), counter(t, remote, "requests"))
+	assert.Equal(t, int64(5), counter(t, local, "requests"), "written during the handoff")
+	m, err := local.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *m.Value, "set during the handoff")
+
+	// and writers racing rebalances
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, local.Update(ctx, "counter", "requests", int64(1)))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		_, err := c.Rebalance(ctx)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int64(10+5+200), counter(t, remote, "requests"), "no write is lost")
+	exported, err := local.Export(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, exported)
+}
+
+func TestRebalanceResendsHandoff(t *testing.T) {
+	ctx := context.Background()
+	local, remote := storage.NewMemStorage(), storage.NewMemStorage()
+	require.NoError(t, local.Update(ctx, "counter", "requests", int64(10)))
+
+	// the response to the first handoff is lost after it was adopted
+	var ids []string
+	node := adoptingNode(t, remote, func(id string) int {
+		ids = append(ids, id)
+		if len(ids) == 1 {
+			return http.StatusBadGateway
+		}
+		return http.StatusOK
+	})
+	defer node.Close()
+	c := New(local, Config{Self: "http://self"})
+	c.SetMembers([]string{node.URL})
+
+	_, err := c.Rebalance(ctx)
+	require.Error(t, err)
+	assert.Equal(t, int64(10), counter(t, local, "requests"), "kept until confirmed")
+	require.NoError(t, local.Update(ctx, "counter", "requests", int64(2)))
+
+	moved, err := c.Rebalance(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, moved, "the resent handoff and the later write")
+	require.Len(t, ids, 3)
+	assert.Equal(t, ids[0], ids[1], "resent with the same id")
+	assert.NotEqual(t, ids[1], ids[2])
+	assert.Equal(t, int64(12), counter(t, remote, "requests"), "adopted once")
+	_, err = local.Return(ctx, "counter", "requests")
+	assert.Error(t, err)
+}
+
+func TestClusterRefusesSnapshots(t *testing.T) {
+	ctx := context.Background()
+	local := storage.NewMemStorage()
+	require.NoError(t, local.Update(ctx, "gauge", "load", 1.0))
+	c := New(local, Config{Self: "http://self"})
+	codec, err := storage.CodecFor("json", "")
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	_, err = storage.ExportFile(ctx, c, path, codec)
+	assert.ErrorIs(t, err, storage.ErrSnapshotUnsupported, "would hold the local share only")
+	_, err = storage.ExportFile(ctx, local, path, codec)
+	require.NoError(t, err)
+	_, err = storage.ImportFile(ctx, c, path, true)
+	assert.ErrorIs(t, err, storage.ErrSnapshotUnsupported, "would replace the local share only")
+}
+
+func TestReadMembers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes")
+	require.NoError(t, os.WriteFile(path, []byte("# nodes\nhttp://a:8080\n\n  http://b:8080  \n"), 0600))
+	nodes, err := ReadMembers(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://a:8080", "http://b:8080"}, nodes)
+
+	_, err = ReadMembers(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
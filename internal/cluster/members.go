@@ -0,0 +1,27 @@
+package cluster
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// ReadMembers reads node urls from path, one per line. blank lines and lines starting with # are skipped
+func ReadMembers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var nodes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		nodes = append(nodes, line)
+	}
+	return nodes, scanner.Err()
+}
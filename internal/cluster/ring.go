@@ -0,0 +1,104 @@
+// Package cluster shards series across server nodes by consistent hashing of their ids.
+package cluster
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultReplicas is the number of points a node has on the ring,
+// more points spread series more evenly
+const DefaultReplicas = 128
+
+// Ring maps series ids to nodes. every node owns replicas points on a hash circle
+// and an id belongs to the first point at or after its hash, so adding or
+// removing a node only moves the ids next to its points
+type Ring struct {
+	nodes  []string
+	points []uint64
+	owners []string // owner of points[i]
+}
+
+// NewRing builds a ring of nodes, duplicates and trailing slashes are ignored
+func NewRing(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{}
+	for _, node := range nodes {
+		node = normalize(node)
+		if node != "" && !slices.Contains(r.nodes, node) {
+			r.nodes = append(r.nodes, node)
+		}
+	}
+	sort.Strings(r.nodes)
+
+	type point struct {
+		hash  uint64
+		owner string
+	}
+	points := make([]point, 0, len(r.nodes)*replicas)
+	for _, node := range r.nodes {
+		for i := 0; i < replicas; i++ {
+			points = append(points, point{hash(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	// ties are broken by node so every process builds the same ring
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+	r.points = make([]uint64, len(points))
+	r.owners = make([]string, len(points))
+	for i, p := range points {
+		r.points[i], r.owners[i] = p.hash, p.owner
+	}
+	return r
+}
+
+// Owner returns the node id belongs to, empty for an empty ring
+func (r *Ring) Owner(id string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(id)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+// Nodes returns members sorted
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Has reports whether node is a member
+func (r *Ring) Has(node string) bool {
+	_, found := slices.BinarySearch(r.nodes, normalize(node))
+	return found
+}
+
+func normalize(node string) string {
+	return strings.TrimRight(strings.TrimSpace(node), "/")
+}
+
+// fnv-1a with a splitmix64 finalizer, plain fnv clusters similar strings like "node#1" and "node#2"
+func hash(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"}
+	ring := NewRing(nodes, DefaultReplicas)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[ring.Owner(fmt.Sprintf("series_%d", i))]++
+	}
+	assert.Len(t, counts, 4)
+	for node, n := range counts {
+		assert.InDelta(t, 2500, n, 600, "share of %s", node)
+	}
+
+	// same ring in every process, whatever the order or spelling of members
+	same := NewRing([]string{"http://d:8080/", "http://c:8080", "http://b:8080", "http://a:8080", "http://a:8080"}, DefaultReplicas)
+	assert.Equal(t, ring.Nodes(), same.Nodes())
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("series_%d", i)
+		assert.Equal(t, ring.Owner(id), same.Owner(id))
+	}
+	assert.True(t, ring.Has("http://a:8080/"))
+	assert.False(t, ring.Has("http://e:8080"))
+}
+
+func TestRingMovesFewSeries(t *testing.T) {
+	before := NewRing([]string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080"}, DefaultReplicas)
+	after := NewRing([]string{"http://a:8080", "http://b:8080", "http://c:8080", "http://d:8080", "http://e:8080"}, DefaultReplicas)
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("series_%d", i)
+		if before.Owner(id) != after.Owner(id) {
+			moved++
+			assert.Equal(t, "http://e:8080", after.Owner(id), "series only move to the new node")
+		}
+	}
+	assert.InDelta(t, 2000, moved, 600)
+}
+
+func TestEmptyRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil, 0).Owner("load"))
+	assert.Empty(t, NewRing([]string{" ", ""}, 0).Nodes())
+}
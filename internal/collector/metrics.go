@@ -1,6 +1,7 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"runtime"
@@ -125,16 +126,23 @@ func ClearMetrics() {
 	MyMetrics = make(Metrics, 0)
 }
 
-// update metrics storage with interval
-func UpdateWithInterval(pollInterval int) {
+// update metrics storage with interval until ctx is done,
+// interval is read before every poll so it can change at runtime
+func UpdateWithInterval(ctx context.Context, pollInterval func() int) {
 	for {
-		time.Sleep(time.Duration(pollInterval) * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(pollInterval()) * time.Second):
+		}
+		start := time.Now()
 		// 1. fetch runtime metrics
 		m := GetRuntimeStats()
 		// 2. check what've changed
 		CompareGauge(m)
 		// 3. update metrics storage
 		UpdateMetrics(m)
+		Telemetry.collected(time.Since(start))
 		fmt.Println("Metrics updated.")
 	}
 }
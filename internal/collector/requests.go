@@ -3,25 +3,27 @@ package collector
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
-	"github.com/paranoiachains/metrics/internal/flags"
+	"github.com/paranoiachains/metrics/internal/config"
 )
 
 // POST request wrapper
-func NewRequest(url string, obj []byte) error {
+func NewRequest(url string, obj []byte, cfg *config.Agent) error {
 	var reqBody *bytes.Buffer
 	reqBody = bytes.NewBuffer(obj)
 
 	// if gzip encoding enabled - encode.
-	if flags.EncodingEnabled {
+	if cfg.Gzip {
 		var buf bytes.Buffer
 		gz := gzip.NewWriter(&buf)
 		_, err := gz.Write(obj)
@@ -32,6 +34,8 @@ func NewRequest(url string, obj []byte) error {
 		reqBody = &buf
 	}
 
+	Telemetry.sentBytes(len(obj), reqBody.Len())
+
 	// new request
 	req, err := http.NewRequest("POST", url, reqBody)
 	if err != nil {
@@ -42,13 +46,13 @@ func NewRequest(url string, obj []byte) error {
 	req.Header.Set("Accept-Encoding", "gzip")
 	req.Header.Set("Content-Type", "application/json")
 
-	if flags.EncodingEnabled {
+	if cfg.Gzip {
 		req.Header.Set("Content-Encoding", "gzip")
 	}
 
 	// adding signature header if flag provided
-	if flags.ClientKey != "" {
-		h := hmac.New(sha256.New, []byte(flags.ClientKey))
+	if cfg.Key != "" {
+		h := hmac.New(sha256.New, []byte(cfg.Key))
 		h.Write(obj)
 		token := h.Sum(nil)
 		hexHash := hex.EncodeToString(token)
@@ -70,46 +74,122 @@ func NewRequest(url string, obj []byte) error {
 	return nil
 }
 
-// Send HTTP requests with collected metrics
-func Send(endpoint string) error {
+var (
+	// persistent connection, used when websocket mode is enabled
+	wsClient *WSClient
+	// telemetry carried by the frame wsClient still waits an ack for
+	wsPendingOwn Metrics
+)
+
+// Send collected metrics together with agent telemetry
+func Send(cfg *config.Agent) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	obj, err := json.Marshal(MyMetrics)
-	if err != nil {
+	Telemetry.attempt()
+	// a frame that may already be applied is settled before anything new is sent
+	if err := settleWS(); err != nil {
+		Telemetry.failure()
 		return err
 	}
 
-	err = NewRequest(fmt.Sprintf("http://%s/updates/", endpoint), obj)
-	if err != nil {
+	own := Telemetry.Metrics(cfg.ID)
+	batch := make(Metrics, 0, len(MyMetrics)+len(own))
+	batch = append(batch, MyMetrics...)
+	batch = append(batch, own...)
+
+	if err := send(cfg, batch); err != nil {
+		if errors.Is(err, ErrWSUnacked) {
+			wsPendingOwn = own
+		}
+		Telemetry.failure()
+		return err
+	}
+	Telemetry.delivered(own)
+	return nil
+}
+
+// settleWS resends the unacknowledged frame, if any, with its original seq
+func settleWS() error {
+	if wsClient == nil || !wsClient.Pending() {
+		return nil
+	}
+	err := wsClient.Resend()
+	if errors.Is(err, ErrWSUnacked) {
 		return err
 	}
+	// a rejected frame was not applied, its telemetry goes out with the next batch
+	if err == nil {
+		Telemetry.delivered(wsPendingOwn)
+	}
+	wsPendingOwn = nil
 	return nil
 }
 
-// Send HTTP requests with collected metrics with interval
-func SendWithInterval(reportInterval int, endpoint string) error {
+// send over websocket if enabled, HTTP otherwise; HTTP is only used when
+// the frame was never written, otherwise the batch could be applied twice
+func send(cfg *config.Agent, batch Metrics) error {
+	if cfg.WebSocket {
+		if wsClient == nil {
+			wsClient = NewWSClient(cfg.Address, cfg.Key)
+		}
+		// key may have been reloaded
+		wsClient.key = cfg.Key
+		err := wsClient.Send(batch)
+		if !errors.Is(err, ErrWSUnavailable) {
+			return err
+		}
+		fmt.Println("Websocket unavailable, falling back to HTTP:", err)
+	}
+
+	obj, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return NewRequest(fmt.Sprintf("http://%s/updates/", cfg.Address), obj, cfg)
+}
+
+// CloseWS closes the persistent websocket connection if there is one
+func CloseWS() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if wsClient == nil {
+		return nil
+	}
+	return wsClient.Close()
+}
+
+// Send HTTP requests with collected metrics with interval until ctx is done,
+// config is read before every report so it can be reloaded at runtime
+func SendWithInterval(ctx context.Context, cfgs *config.Store[config.Agent]) error {
 	for {
-		time.Sleep(time.Duration(reportInterval) * time.Second)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Duration(cfgs.Get().ReportInterval) * time.Second):
+		}
+		cfg := cfgs.Get()
 
-		var lastErr error
+		// every failed attempt but the last is followed by a retry
 		retryDelays := []time.Duration{1, 3, 5}
-
+		lastErr := Send(cfg)
 		for _, delay := range retryDelays {
-			if err := Send(endpoint); err == nil {
-				fmt.Println("Metrics sent!")
-				lastErr = nil
+			if lastErr == nil {
 				break
-			} else {
-				lastErr = err
-				fmt.Printf("Send failed, retrying in %v...\n", delay*time.Second)
-				time.Sleep(delay * time.Second)
 			}
+			Telemetry.retry()
+			fmt.Printf("Send failed, retrying in %v...\n", delay*time.Second)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay * time.Second):
+			}
+			lastErr = Send(cfg)
 		}
-
 		if lastErr != nil {
 			fmt.Println("error: ", lastErr)
 			log.Fatal("No connection to server, exiting program")
 		}
+		fmt.Println("Metrics sent!")
 	}
 }
@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telemetry holds the agent's own stats, reported as agent.<id>.* metrics
+// in the same batch as collected metrics. the id keeps agents sharing a server apart
+var Telemetry = &AgentTelemetry{}
+
+type AgentTelemetry struct {
+	mu sync.Mutex
+
+	// counter deltas not yet delivered to the server
+	attempts  int64
+	failures  int64
+	retries   int64
+	bytesRaw  int64
+	bytesGzip int64
+
+	pendingPolls    int64 // polls collected since the last successful send
+	lastSuccess     time.Time
+	collectDuration time.Duration
+}
+
+func (t *AgentTelemetry) attempt() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+}
+
+func (t *AgentTelemetry) failure() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures++
+}
+
+func (t *AgentTelemetry) retry() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retries++
+}
+
+func (t *AgentTelemetry) sentBytes(raw, gzipped int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bytesRaw += int64(raw)
+	t.bytesGzip += int64(gzipped)
+}
+
+func (t *AgentTelemetry) collected(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pendingPolls++
+	t.collectDuration = d
+}
+
+// counter deltas by series name
+func (t *AgentTelemetry) counters() map[string]*int64 {
+	return map[string]*int64{
+		"send.attempts": &t.attempts,
+		"send.failures": &t.failures,
+		"send.retries":  &t.retries,
+		"bytes.raw":     &t.bytesRaw,
+		"bytes.gzip":    &t.bytesGzip,
+	}
+}
+
+// Metrics returns current stats of the given agent, counters are deltas since the last delivered report
+func (t *AgentTelemetry) Metrics(agent string) Metrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prefix := "agent." + agent + "."
+	gauges := map[string]float64{
+		"pending_polls":              float64(t.pendingPolls),
+		"collect.duration_seconds":   t.collectDuration.Seconds(),
+		"send.last_success_unixtime": 0,
+	}
+	if !t.lastSuccess.IsZero() {
+		gauges["send.last_success_unixtime"] = float64(t.lastSuccess.Unix())
+	}
+
+	counters := t.counters()
+	metrics := make(Metrics, 0, len(counters)+len(gauges))
+	for name, delta := range counters {
+		d := *delta
+		metrics = append(metrics, Metric{ID: prefix + name, MType: "counter", Delta: &d})
+	}
+	for name, value := range gauges {
+		v := value
+		metrics = append(metrics, Metric{ID: prefix + name, MType: "gauge", Value: &v})
+	}
+	return metrics
+}
+
+// delivered subtracts reported counter deltas after a successful send
+func (t *AgentTelemetry) delivered(reported Metrics) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counters := t.counters()
+	for _, m := range reported {
+		if m.Delta == nil {
+			continue
+		}
+		for name, delta := range counters {
+			if strings.HasSuffix(m.ID, "."+name) {
+				*delta -= *m.Delta
+			}
+		}
+	}
+	t.pendingPolls = 0
+	t.lastSuccess = time.Now()
+}
@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsMinBackoff = time.Second
+	wsMaxBackoff = 30 * time.Second
+	wsAckTimeout = 5 * time.Second
+)
+
+// Frame is a single batch of metrics sent over websocket
+type Frame struct {
+	Agent   string          `json:"agent,omitempty"` // random per-process id, the server dedups on (Agent, Seq)
+	Seq     int64           `json:"seq"`
+	Metrics json.RawMessage `json:"metrics"`        // encoded Metrics
+	Hash    string          `json:"hash,omitempty"` // HMAC of Metrics, same key as HashSHA256 header
+}
+
+// Ack is the server reply to a Frame with the same Seq
+type Ack struct {
+	Seq    int64  `json:"seq"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	// ErrWSUnavailable means the frame was not written and HTTP should be used instead
+	ErrWSUnavailable = errors.New("websocket unavailable")
+	// ErrWSUnacked means the frame was written but not acknowledged, it may
+	// already be applied and is resent with the same seq by Resend
+	ErrWSUnacked = errors.New("websocket frame not acknowledged")
+)
+
+// long-lived agent connection, reconnects lazily with exponential backoff
+type WSClient struct {
+	url      string
+	key      string
+	agent    string
+	conn     *websocket.Conn
+	seq      int64
+	pending  *Frame // written but not acknowledged
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+func NewWSClient(endpoint string, key string) *WSClient {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &WSClient{
+		url:   fmt.Sprintf("ws://%s/ws/updates", endpoint),
+		key:   key,
+		agent: hex.EncodeToString(id),
+	}
+}
+
+// Pending reports whether a written frame still waits for its ack
+func (w *WSClient) Pending() bool {
+	return w.pending != nil
+}
+
+// Send writes one frame and waits for its ack. A frame left pending by an
+// earlier call must be settled with Resend first.
+func (w *WSClient) Send(metrics Metrics) error {
+	if w.pending != nil {
+		return fmt.Errorf("%w: frame %d", ErrWSUnacked, w.pending.Seq)
+	}
+	if err := w.connect(); err != nil {
+		return err
+	}
+
+	obj, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	// websocket frames are not compressed
+	Telemetry.sentBytes(len(obj), len(obj))
+
+	w.seq++
+	frame := Frame{Agent: w.agent, Seq: w.seq, Metrics: obj}
+	if w.key != "" {
+		h := hmac.New(sha256.New, []byte(w.key))
+		h.Write(obj)
+		frame.Hash = hex.EncodeToString(h.Sum(nil))
+	}
+	return w.write(&frame)
+}
+
+// Resend writes the pending frame again with its original seq,
+// the server acks it without applying it twice
+func (w *WSClient) Resend() error {
+	if w.pending == nil {
+		return nil
+	}
+	frame := w.pending
+	if err := w.connect(); err != nil {
+		return fmt.Errorf("%w: frame %d: %v", ErrWSUnacked, frame.Seq, err)
+	}
+	err := w.write(frame)
+	if errors.Is(err, ErrWSUnavailable) {
+		// the first write may still have been applied
+		return fmt.Errorf("%w: frame %d: %v", ErrWSUnacked, frame.Seq, err)
+	}
+	if !errors.Is(err, ErrWSUnacked) {
+		w.pending = nil
+	}
+	return err
+}
+
+// write sends frame and waits for its ack; once the frame is on the wire
+// it is kept as pending until acknowledged
+func (w *WSClient) write(frame *Frame) error {
+	w.conn.SetWriteDeadline(time.Now().Add(wsAckTimeout))
+	if err := w.conn.WriteJSON(frame); err != nil {
+		w.fail()
+		return fmt.Errorf("%w: %v", ErrWSUnavailable, err)
+	}
+
+	var ack Ack
+	w.conn.SetReadDeadline(time.Now().Add(wsAckTimeout))
+	if err := w.conn.ReadJSON(&ack); err != nil {
+		w.pending = frame
+		w.fail()
+		return fmt.Errorf("%w: %v", ErrWSUnacked, err)
+	}
+	if ack.Seq != frame.Seq {
+		w.pending = frame
+		w.fail()
+		return fmt.Errorf("%w: ack for frame %d, want %d", ErrWSUnacked, ack.Seq, frame.Seq)
+	}
+	if ack.Status != "ok" {
+		return fmt.Errorf("frame rejected: %s", ack.Error)
+	}
+	return nil
+}
+
+func (w *WSClient) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	w.conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+func (w *WSClient) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+	if time.Now().Before(w.nextDial) {
+		return ErrWSUnavailable
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial(w.url, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			err = fmt.Errorf("upgrade failed with status %v", resp.StatusCode)
+		}
+		w.fail()
+		return fmt.Errorf("%w: %v", ErrWSUnavailable, err)
+	}
+	w.conn = conn
+	w.backoff = 0
+	return nil
+}
+
+// drop connection and schedule next dial
+func (w *WSClient) fail() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	if w.backoff == 0 {
+		w.backoff = wsMinBackoff
+	} else if w.backoff < wsMaxBackoff {
+		w.backoff *= 2
+	}
+	w.nextDial = time.Now().Add(w.backoff)
+}
@@ -0,0 +1,695 @@
+// Package config loads server and agent configuration.
+//
+// Every setting is resolved with the following precedence:
+//
+//	command line flags > environment variables > config file > defaults
+//
+// The config file is given with -c or CONFIG and may be YAML (.yaml, .yml)
+// or TOML (.toml).
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v11"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[REDACTED]"
+
+type Server struct {
+	Address         string   `yaml:"address" toml:"address" env:"ADDRESS"`
+	StoreInterval   int      `yaml:"store_interval" toml:"store_interval" env:"STORE_INTERVAL"`
+	FileStoragePath string   `yaml:"file_storage_path" toml:"file_storage_path" env:"FILE_STORAGE_PATH"`
+	Restore         bool     `yaml:"restore" toml:"restore" env:"RESTORE"`
+	Storage         string   `yaml:"storage" toml:"storage" env:"STORAGE"`
+	DatabaseDSN     string   `yaml:"database_dsn" toml:"database_dsn" env:"DATABASE_DSN"`
+	DatabaseDriver  string   `yaml:"database_driver" toml:"database_driver" env:"DATABASE_DRIVER"`
+	DB              DB       `yaml:"db" toml:"db" envPrefix:"DB_"`
+	History         History  `yaml:"history" toml:"history" envPrefix:"HISTORY_"`
+	Cache           Cache    `yaml:"cache" toml:"cache" envPrefix:"CACHE_"`
+	StorageLayers   Layers   `yaml:"storage_layers" toml:"storage_layers" envPrefix:"STORAGE_"`
+	Cluster         Cluster  `yaml:"cluster" toml:"cluster" envPrefix:"CLUSTER_"`
+	Webhooks        Webhooks `yaml:"webhooks" toml:"webhooks" envPrefix:"WEBHOOK_"`
+	Key             string   `yaml:"key" toml:"key" env:"KEY"`
+	AdminToken      string   `yaml:"admin_token" toml:"admin_token" env:"ADMIN_TOKEN"`
+	BackupDir       string   `yaml:"backup_dir" toml:"backup_dir" env:"BACKUP_DIR"`
+	LogLevel        string   `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL"`
+	SnapshotKeep    int      `yaml:"snapshot_keep" toml:"snapshot_keep" env:"SNAPSHOT_KEEP"`
+	SnapshotFormat  string   `yaml:"snapshot_format" toml:"snapshot_format" env:"SNAPSHOT_FORMAT"`
+	WAL             bool     `yaml:"wal" toml:"wal" env:"WAL"`
+	WALSyncMillis   int      `yaml:"wal_sync_ms" toml:"wal_sync_ms" env:"WAL_SYNC_MS"`
+}
+
+// DB tunes the postgres connection pool and failure handling
+type DB struct {
+	MaxOpenConns       int `yaml:"max_open_conns" toml:"max_open_conns" env:"MAX_OPEN_CONNS"` // 0 picks a size from the cpu count
+	MaxIdleConns       int `yaml:"max_idle_conns" toml:"max_idle_conns" env:"MAX_IDLE_CONNS"`
+	ConnMaxLifetimeSec int `yaml:"conn_max_lifetime_s" toml:"conn_max_lifetime_s" env:"CONN_MAX_LIFETIME_S"`
+	ConnMaxIdleSec     int `yaml:"conn_max_idle_s" toml:"conn_max_idle_s" env:"CONN_MAX_IDLE_S"`
+	StatementTimeoutMs int `yaml:"statement_timeout_ms" toml:"statement_timeout_ms" env:"STATEMENT_TIMEOUT_MS"` // 0 disables it
+	RetryAttempts      int `yaml:"retry_attempts" toml:"retry_attempts" env:"RETRY_ATTEMPTS"`
+	RetryBaseMs        int `yaml:"retry_base_ms" toml:"retry_base_ms" env:"RETRY_BASE_MS"`
+	RetryMaxMs         int `yaml:"retry_max_ms" toml:"retry_max_ms" env:"RETRY_MAX_MS"`
+	BreakerThreshold   int `yaml:"breaker_threshold" toml:"breaker_threshold" env:"BREAKER_THRESHOLD"` // 0 disables the breaker
+	BreakerCooldownSec int `yaml:"breaker_cooldown_s" toml:"breaker_cooldown_s" env:"BREAKER_COOLDOWN_S"`
+}
+
+func DefaultDB() DB {
+	return DB{
+		ConnMaxLifetimeSec: 1800,
+		ConnMaxIdleSec:     300,
+		StatementTimeoutMs: 30000,
+		RetryAttempts:      4,
+		RetryBaseMs:        500,
+		RetryMaxMs:         5000,
+		BreakerThreshold:   5,
+		BreakerCooldownSec: 10,
+	}
+}
+
+// History keeps timestamped samples in postgres, partitioned by time
+type History struct {
+	Enabled       bool   `yaml:"enabled" toml:"enabled" env:"ENABLED"`
+	Partition     string `yaml:"partition" toml:"partition" env:"PARTITION"` // day or week
+	Ahead         int    `yaml:"ahead" toml:"ahead" env:"AHEAD"`
+	RetentionDays int    `yaml:"retention_days" toml:"retention_days" env:"RETENTION_DAYS"` // 0 keeps samples forever
+}
+
+func DefaultHistory() History {
+	return History{
+		Partition:     "day",
+		Ahead:         3,
+		RetentionDays: 30,
+	}
+}
+
+// Cache serves postgres reads from memory, invalidated by LISTEN/NOTIFY
+type Cache struct {
+	Enabled bool `yaml:"enabled" toml:"enabled" env:"ENABLED"`
+	Size    int  `yaml:"size" toml:"size" env:"SIZE"`
+	TTLMs   int  `yaml:"ttl_ms" toml:"ttl_ms" env:"TTL_MS"` // 0 keeps entries until evicted or invalidated
+}
+
+func DefaultCache() Cache {
+	return Cache{
+		Size:  10000,
+		TTLMs: 30000,
+	}
+}
+
+// Layers wrap the storage, outermost first: trace, stats, log, chaos
+type Layers struct {
+	Stats            bool    `yaml:"stats" toml:"stats" env:"STATS"`
+	Log              bool    `yaml:"log" toml:"log" env:"LOG"`       // every operation at debug level
+	Trace            bool    `yaml:"trace" toml:"trace" env:"TRACE"` // OTLP/HTTP, configured by OTEL_EXPORTER_OTLP_* variables
+	ChaosLatencyMs   int     `yaml:"chaos_latency_ms" toml:"chaos_latency_ms" env:"CHAOS_LATENCY_MS"`
+	ChaosLatencyRate float64 `yaml:"chaos_latency_rate" toml:"chaos_latency_rate" env:"CHAOS_LATENCY_RATE"`
+	ChaosErrorRate   float64 `yaml:"chaos_error_rate" toml:"chaos_error_rate" env:"CHAOS_ERROR_RATE"`
+}
+
+func DefaultLayers() Layers {
+	return Layers{Stats: true}
+}
+
+// Chaos reports whether faults are injected
+func (l Layers) Chaos() bool {
+	return (l.ChaosLatencyMs > 0 && l.ChaosLatencyRate > 0) || l.ChaosErrorRate > 0
+}
+
+// Cluster shards series across nodes by consistent hashing of their ids
+type Cluster struct {
+	Self       string   `yaml:"self" toml:"self" env:"SELF"` // url other nodes reach this one at, empty disables clustering
+	Nodes      []string `yaml:"nodes" toml:"nodes" env:"NODES" envSeparator:","`
+	NodesFile  string   `yaml:"nodes_file" toml:"nodes_file" env:"NODES_FILE"` // one url per line, added to nodes
+	Replicas   int      `yaml:"replicas" toml:"replicas" env:"REPLICAS"`       // ring points per node
+	RefreshSec int      `yaml:"refresh_s" toml:"refresh_s" env:"REFRESH_S"`    // how often nodes_file is read
+}
+
+func DefaultCluster() Cluster {
+	return Cluster{
+		Replicas:   128,
+		RefreshSec: 5,
+	}
+}
+
+func (c Cluster) Enabled() bool {
+	return c.Self != ""
+}
+
+func (c Cluster) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	var errs []error
+	for _, node := range append([]string{c.Self}, c.Nodes...) {
+		u, err := url.Parse(node)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("cluster node %q must be an http or https url", node))
+		}
+	}
+	if len(c.Nodes) == 0 && c.NodesFile == "" {
+		errs = append(errs, errors.New("cluster needs nodes or nodes_file"))
+	}
+	if c.Replicas < 1 {
+		errs = append(errs, fmt.Errorf("cluster.replicas must be at least 1, got %d", c.Replicas))
+	}
+	if c.RefreshSec < 1 {
+		errs = append(errs, fmt.Errorf("cluster.refresh_s must be at least 1, got %d", c.RefreshSec))
+	}
+	return errors.Join(errs...)
+}
+
+// Webhooks receive alert state changes as signed json
+type Webhooks struct {
+	URLs        []string `yaml:"urls" toml:"urls" env:"URLS" envSeparator:","` // empty disables notifications
+	Key         string   `yaml:"key" toml:"key" env:"KEY"`                     // HMAC key, payloads are not signed if empty
+	GroupWaitMs int      `yaml:"group_wait_ms" toml:"group_wait_ms" env:"GROUP_WAIT_MS"`
+	MaxAttempts int      `yaml:"max_attempts" toml:"max_attempts" env:"MAX_ATTEMPTS"`
+	BackoffMs   int      `yaml:"backoff_ms" toml:"backoff_ms" env:"BACKOFF_MS"` // doubled on every retry
+	TimeoutMs   int      `yaml:"timeout_ms" toml:"timeout_ms" env:"TIMEOUT_MS"`
+}
+
+func DefaultWebhooks() Webhooks {
+	return Webhooks{
+		GroupWaitMs: 1000,
+		MaxAttempts: 4,
+		BackoffMs:   1000,
+		TimeoutMs:   5000,
+	}
+}
+
+func (w Webhooks) Enabled() bool {
+	return len(w.URLs) > 0
+}
+
+func (w Webhooks) Validate() error {
+	var errs []error
+	for _, u := range w.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("webhook %q must be an http or https url", u))
+		}
+	}
+	if w.GroupWaitMs < 0 {
+		errs = append(errs, fmt.Errorf("webhooks.group_wait_ms must not be negative, got %d", w.GroupWaitMs))
+	}
+	if w.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhooks.max_attempts must be at least 1, got %d", w.MaxAttempts))
+	}
+	if w.BackoffMs < 1 {
+		errs = append(errs, fmt.Errorf("webhooks.backoff_ms must be at least 1, got %d", w.BackoffMs))
+	}
+	if w.TimeoutMs < 1 {
+		errs = append(errs, fmt.Errorf("webhooks.timeout_ms must be at least 1, got %d", w.TimeoutMs))
+	}
+	return errors.Join(errs...)
+}
+
+func DefaultServer() Server {
+	return Server{
+		Address:         "localhost:8080",
+		StoreInterval:   300,
+		FileStoragePath: "tmp/metrics-db.json",
+		Restore:         true,
+		DatabaseDriver:  "pgx",
+		DB:              DefaultDB(),
+		History:         DefaultHistory(),
+		Cache:           DefaultCache(),
+		StorageLayers:   DefaultLayers(),
+		Cluster:         DefaultCluster(),
+		Webhooks:        DefaultWebhooks(),
+		BackupDir:       "tmp/backups",
+		LogLevel:        "info",
+		SnapshotKeep:    3,
+		WAL:             true,
+		WALSyncMillis:   100,
+	}
+}
+
+type Agent struct {
+	Address        string `yaml:"address" toml:"address" env:"ADDRESS"`
+	ReportInterval int    `yaml:"report_interval" toml:"report_interval" env:"REPORT_INTERVAL"`
+	PollInterval   int    `yaml:"poll_interval" toml:"poll_interval" env:"POLL_INTERVAL"`
+	Gzip           bool   `yaml:"gzip" toml:"gzip" env:"GZIP"`
+	Key            string `yaml:"key" toml:"key" env:"KEY"`
+	WebSocket      bool   `yaml:"websocket" toml:"websocket" env:"WEBSOCKET"`
+	ID             string `yaml:"id" toml:"id" env:"AGENT_ID"` // names the agent's own series, agent.<id>.*
+}
+
+func DefaultAgent() Agent {
+	return Agent{
+		ID:             DefaultAgentID(),
+		Address:        "localhost:8080",
+		ReportInterval: 10,
+		PollInterval:   2,
+		Gzip:           true,
+	}
+}
+
+// DefaultAgentID is the host name, dots are replaced so it stays one part of a series id
+func DefaultAgentID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "unknown"
+	}
+	return strings.ReplaceAll(host, ".", "_")
+}
+
+// LoadServer resolves server config from args, environment and config file
+func LoadServer(args []string) (*Server, error) {
+	cfg := DefaultServer()
+	fromFlags := cfg
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("c", "", "config file path (yaml or toml)")
+	fs.StringVar(&fromFlags.Address, "a", cfg.Address, "Set server endpoint")
+	fs.IntVar(&fromFlags.StoreInterval, "i", cfg.StoreInterval, "store interval of metric in seconds")
+	fs.StringVar(&fromFlags.FileStoragePath, "f", cfg.FileStoragePath, "storage file path path")
+	fs.BoolVar(&fromFlags.Restore, "r", cfg.Restore, "restore previous metrics")
+	fs.StringVar(&fromFlags.Storage, "storage", cfg.Storage, "storage backend: memory, kv:<dir> or postgres://..., overrides -d")
+	fs.StringVar(&fromFlags.DatabaseDSN, "d", cfg.DatabaseDSN, "database endpoint")
+	fs.StringVar(&fromFlags.DatabaseDriver, "database-driver", cfg.DatabaseDriver, "postgres client: pgx (native pool, COPY batches) or sql (database/sql)")
+	fs.IntVar(&fromFlags.DB.MaxOpenConns, "db-max-open-conns", cfg.DB.MaxOpenConns, "max open postgres connections, 0 picks a size from the cpu count")
+	fs.IntVar(&fromFlags.DB.MaxIdleConns, "db-max-idle-conns", cfg.DB.MaxIdleConns, "max idle postgres connections of the sql driver")
+	fs.IntVar(&fromFlags.DB.ConnMaxLifetimeSec, "db-conn-max-lifetime-s", cfg.DB.ConnMaxLifetimeSec, "postgres connection lifetime in seconds")
+	fs.IntVar(&fromFlags.DB.ConnMaxIdleSec, "db-conn-max-idle-s", cfg.DB.ConnMaxIdleSec, "postgres connection idle time in seconds")
+	fs.IntVar(&fromFlags.DB.StatementTimeoutMs, "db-statement-timeout-ms", cfg.DB.StatementTimeoutMs, "postgres statement_timeout in milliseconds, 0 disables it")
+	fs.IntVar(&fromFlags.DB.RetryAttempts, "db-retry-attempts", cfg.DB.RetryAttempts, "tries of a postgres call failing with a connection error")
+	fs.IntVar(&fromFlags.DB.RetryBaseMs, "db-retry-base-ms", cfg.DB.RetryBaseMs, "first postgres retry backoff in milliseconds, doubled every retry")
+	fs.IntVar(&fromFlags.DB.RetryMaxMs, "db-retry-max-ms", cfg.DB.RetryMaxMs, "max postgres retry backoff in milliseconds")
+	fs.IntVar(&fromFlags.DB.BreakerThreshold, "db-breaker-threshold", cfg.DB.BreakerThreshold, "consecutive postgres connection failures that make calls fail fast, 0 disables it")
+	fs.IntVar(&fromFlags.DB.BreakerCooldownSec, "db-breaker-cooldown-s", cfg.DB.BreakerCooldownSec, "seconds before a failing-fast postgres is tried again")
+	fs.BoolVar(&fromFlags.History.Enabled, "history", cfg.History.Enabled, "keep timestamped samples in postgres")
+	fs.StringVar(&fromFlags.History.Partition, "history-partition", cfg.History.Partition, "sample partition size: day or week")
+	fs.IntVar(&fromFlags.History.Ahead, "history-ahead", cfg.History.Ahead, "sample partitions created ahead of time")
+	fs.IntVar(&fromFlags.History.RetentionDays, "history-retention-days", cfg.History.RetentionDays, "days samples are kept, 0 keeps them forever")
+	fs.BoolVar(&fromFlags.Cache.Enabled, "cache", cfg.Cache.Enabled, "serve postgres reads from an in-memory cache")
+	fs.IntVar(&fromFlags.Cache.Size, "cache-size", cfg.Cache.Size, "max cached series")
+	fs.IntVar(&fromFlags.Cache.TTLMs, "cache-ttl-ms", cfg.Cache.TTLMs, "cached value lifetime in milliseconds, 0 keeps them until evicted")
+	fs.BoolVar(&fromFlags.StorageLayers.Stats, "storage-stats", cfg.StorageLayers.Stats, "record storage latency and errors in the server's own stats")
+	fs.BoolVar(&fromFlags.StorageLayers.Log, "storage-log", cfg.StorageLayers.Log, "log every storage operation at debug level")
+	fs.BoolVar(&fromFlags.StorageLayers.Trace, "storage-trace", cfg.StorageLayers.Trace, "export a span per storage operation over OTLP/HTTP")
+	fs.IntVar(&fromFlags.StorageLayers.ChaosLatencyMs, "chaos-latency-ms", cfg.StorageLayers.ChaosLatencyMs, "latency injected into storage operations in milliseconds")
+	fs.Float64Var(&fromFlags.StorageLayers.ChaosLatencyRate, "chaos-latency-rate", cfg.StorageLayers.ChaosLatencyRate, "share of storage operations delayed, 0 to 1")
+	fs.Float64Var(&fromFlags.StorageLayers.ChaosErrorRate, "chaos-error-rate", cfg.StorageLayers.ChaosErrorRate, "share of storage operations failed, 0 to 1")
+	fs.StringVar(&fromFlags.Cluster.Self, "cluster-self", cfg.Cluster.Self, "url other cluster nodes reach this one at, enables clustering")
+	nodes := fs.String("cluster-nodes", strings.Join(cfg.Cluster.Nodes, ","), "comma separated urls of cluster nodes")
+	fs.StringVar(&fromFlags.Cluster.NodesFile, "cluster-nodes-file", cfg.Cluster.NodesFile, "file with one cluster node url per line, reread while running")
+	fs.IntVar(&fromFlags.Cluster.Replicas, "cluster-replicas", cfg.Cluster.Replicas, "hash ring points per cluster node")
+	fs.IntVar(&fromFlags.Cluster.RefreshSec, "cluster-refresh-s", cfg.Cluster.RefreshSec, "seconds between reads of the cluster nodes file")
+	webhooks := fs.String("webhook-urls", strings.Join(cfg.Webhooks.URLs, ","), "comma separated urls alert state changes are posted to")
+	fs.StringVar(&fromFlags.Webhooks.Key, "webhook-key", cfg.Webhooks.Key, "webhook payload signature key")
+	fs.StringVar(&fromFlags.Key, "k", cfg.Key, "server signature key")
+	fs.StringVar(&fromFlags.AdminToken, "admin-token", cfg.AdminToken, "bearer token for /admin endpoints, they are disabled if empty")
+	fs.StringVar(&fromFlags.BackupDir, "backup-dir", cfg.BackupDir, "directory for snapshots made by /admin/snapshot")
+	fs.StringVar(&fromFlags.LogLevel, "l", cfg.LogLevel, "log level")
+	fs.IntVar(&fromFlags.SnapshotKeep, "snapshot-keep", cfg.SnapshotKeep, "number of storage snapshots kept for fallback")
+	fs.StringVar(&fromFlags.SnapshotFormat, "snapshot-format", cfg.SnapshotFormat, "storage file format: json, gob or protobuf, chosen by file extension if empty")
+	fs.BoolVar(&fromFlags.WAL, "wal", cfg.WAL, "log updates to a write-ahead log next to the storage file")
+	fs.IntVar(&fromFlags.WALSyncMillis, "wal-sync-ms", cfg.WALSyncMillis, "wal fsync interval in milliseconds, 0 syncs every update")
+
+	err := load(fs, args, path, &cfg, func(name string) {
+		switch name {
+		case "a":
+			cfg.Address = fromFlags.Address
+		case "i":
+			cfg.StoreInterval = fromFlags.StoreInterval
+		case "f":
+			cfg.FileStoragePath = fromFlags.FileStoragePath
+		case "r":
+			cfg.Restore = fromFlags.Restore
+		case "storage":
+			cfg.Storage = fromFlags.Storage
+		case "d":
+			cfg.DatabaseDSN = fromFlags.DatabaseDSN
+		case "database-driver":
+			cfg.DatabaseDriver = fromFlags.DatabaseDriver
+		case "db-max-open-conns":
+			cfg.DB.MaxOpenConns = fromFlags.DB.MaxOpenConns
+		case "db-max-idle-conns":
+			cfg.DB.MaxIdleConns = fromFlags.DB.MaxIdleConns
+		case "db-conn-max-lifetime-s":
+			cfg.DB.ConnMaxLifetimeSec = fromFlags.DB.ConnMaxLifetimeSec
+		case "db-conn-max-idle-s":
+			cfg.DB.ConnMaxIdleSec = fromFlags.DB.ConnMaxIdleSec
+		case "db-statement-timeout-ms":
+			cfg.DB.StatementTimeoutMs = fromFlags.DB.StatementTimeoutMs
+		case "db-retry-attempts":
+			cfg.DB.RetryAttempts = fromFlags.DB.RetryAttempts
+		case "db-retry-base-ms":
+			cfg.DB.RetryBaseMs = fromFlags.DB.RetryBaseMs
+		case "db-retry-max-ms":
+			cfg.DB.RetryMaxMs = fromFlags.DB.RetryMaxMs
+		case "db-breaker-threshold":
+			cfg.DB.BreakerThreshold = fromFlags.DB.BreakerThreshold
+		case "db-breaker-cooldown-s":
+			cfg.DB.BreakerCooldownSec = fromFlags.DB.BreakerCooldownSec
+		case "history":
+			cfg.History.Enabled = fromFlags.History.Enabled
+		case "history-partition":
+			cfg.History.Partition = fromFlags.History.Partition
+		case "history-ahead":
+			cfg.History.Ahead = fromFlags.History.Ahead
+		case "history-retention-days":
+			cfg.History.RetentionDays = fromFlags.History.RetentionDays
+		case "cache":
+			cfg.Cache.Enabled = fromFlags.Cache.Enabled
+		case "cache-size":
+			cfg.Cache.Size = fromFlags.Cache.Size
+		case "cache-ttl-ms":
+			cfg.Cache.TTLMs = fromFlags.Cache.TTLMs
+		case "storage-stats":
+			cfg.StorageLayers.Stats = fromFlags.StorageLayers.Stats
+		case "storage-log":
+			cfg.StorageLayers.Log = fromFlags.StorageLayers.Log
+		case "storage-trace":
+			cfg.StorageLayers.Trace = fromFlags.StorageLayers.Trace
+		case "chaos-latency-ms":
+			cfg.StorageLayers.ChaosLatencyMs = fromFlags.StorageLayers.ChaosLatencyMs
+		case "chaos-latency-rate":
+			cfg.StorageLayers.ChaosLatencyRate = fromFlags.StorageLayers.ChaosLatencyRate
+		case "chaos-error-rate":
+			cfg.StorageLayers.ChaosErrorRate = fromFlags.StorageLayers.ChaosErrorRate
+		case "cluster-self":
+			cfg.Cluster.Self = fromFlags.Cluster.Self
+		case "cluster-nodes":
+			cfg.Cluster.Nodes = splitList(*nodes)
+		case "cluster-nodes-file":
+			cfg.Cluster.NodesFile = fromFlags.Cluster.NodesFile
+		case "cluster-replicas":
+			cfg.Cluster.Replicas = fromFlags.Cluster.Replicas
+		case "cluster-refresh-s":
+			cfg.Cluster.RefreshSec = fromFlags.Cluster.RefreshSec
+		case "webhook-urls":
+			cfg.Webhooks.URLs = splitList(*webhooks)
+		case "webhook-key":
+			cfg.Webhooks.Key = fromFlags.Webhooks.Key
+		case "k":
+			cfg.Key = fromFlags.Key
+		case "admin-token":
+			cfg.AdminToken = fromFlags.AdminToken
+		case "backup-dir":
+			cfg.BackupDir = fromFlags.BackupDir
+		case "l":
+			cfg.LogLevel = fromFlags.LogLevel
+		case "snapshot-keep":
+			cfg.SnapshotKeep = fromFlags.SnapshotKeep
+		case "snapshot-format":
+			cfg.SnapshotFormat = fromFlags.SnapshotFormat
+		case "wal":
+			cfg.WAL = fromFlags.WAL
+		case "wal-sync-ms":
+			cfg.WALSyncMillis = fromFlags.WALSyncMillis
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadAgent resolves agent config from args, environment and config file
+func LoadAgent(args []string) (*Agent, error) {
+	cfg := DefaultAgent()
+	fromFlags := cfg
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	path := fs.String("c", "", "config file path (yaml or toml)")
+	fs.StringVar(&fromFlags.Address, "a", cfg.Address, "Set client endpoint")
+	fs.IntVar(&fromFlags.ReportInterval, "r", cfg.ReportInterval, "Set report interval")
+	fs.IntVar(&fromFlags.PollInterval, "p", cfg.PollInterval, "Set poll interval")
+	fs.BoolVar(&fromFlags.Gzip, "e", cfg.Gzip, "enable gzip encoding of http requests")
+	fs.StringVar(&fromFlags.Key, "k", cfg.Key, "client signature key")
+	fs.BoolVar(&fromFlags.WebSocket, "ws", cfg.WebSocket, "send metrics over a persistent websocket")
+	fs.StringVar(&fromFlags.ID, "id", cfg.ID, "agent id in the names of its own metrics, host name by default")
+
+	err := load(fs, args, path, &cfg, func(name string) {
+		switch name {
+		case "a":
+			cfg.Address = fromFlags.Address
+		case "r":
+			cfg.ReportInterval = fromFlags.ReportInterval
+		case "p":
+			cfg.PollInterval = fromFlags.PollInterval
+		case "e":
+			cfg.Gzip = fromFlags.Gzip
+		case "k":
+			cfg.Key = fromFlags.Key
+		case "ws":
+			cfg.WebSocket = fromFlags.WebSocket
+		case "id":
+			cfg.ID = fromFlags.ID
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// load applies file, env and explicitly set flags on top of cfg defaults
+func load(fs *flag.FlagSet, args []string, path *string, cfg any, applyFlag func(name string)) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	file := *path
+	if file == "" {
+		file = os.Getenv("CONFIG")
+	}
+	if file != "" {
+		if err := LoadFile(file, cfg); err != nil {
+			return err
+		}
+	}
+
+	if err := env.Parse(cfg); err != nil {
+		return err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		applyFlag(f.Name)
+	})
+	return nil
+}
+
+// LoadFile decodes a yaml or toml file into cfg, format is chosen by extension
+func LoadFile(path string, cfg any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, cfg)
+	case ".toml":
+		err = toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config file: unsupported format %q", filepath.Ext(path))
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// StorageURL is storage if set, else postgres:<database_dsn> if set, else memory
+func (c Server) StorageURL() string {
+	switch {
+	case c.Storage != "":
+		return c.Storage
+	case c.DatabaseDSN != "":
+		return "postgres:" + c.DatabaseDSN
+	default:
+		return "memory"
+	}
+}
+
+// Validate reports every problem at once
+func (c Server) Validate() error {
+	var errs []error
+	if err := validateAddress(c.Address); err != nil {
+		errs = append(errs, err)
+	}
+	if c.StoreInterval < 0 {
+		errs = append(errs, fmt.Errorf("store_interval must not be negative, got %d", c.StoreInterval))
+	}
+	backend, _, _ := strings.Cut(c.StorageURL(), ":")
+	if backend == "memory" && c.FileStoragePath == "" {
+		errs = append(errs, errors.New("file_storage_path is required for memory storage"))
+	}
+	if c.DatabaseDriver != "pgx" && c.DatabaseDriver != "sql" {
+		errs = append(errs, fmt.Errorf("database_driver must be pgx or sql, got %q", c.DatabaseDriver))
+	}
+	if err := c.DB.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.History.Enabled && backend == "memory" {
+		errs = append(errs, errors.New("history requires postgres or kv storage"))
+	}
+	if c.History.Partition != "day" && c.History.Partition != "week" {
+		errs = append(errs, fmt.Errorf("history.partition must be day or week, got %q", c.History.Partition))
+	}
+	if c.History.Ahead < 0 {
+		errs = append(errs, fmt.Errorf("history.ahead must not be negative, got %d", c.History.Ahead))
+	}
+	if c.History.RetentionDays < 0 {
+		errs = append(errs, fmt.Errorf("history.retention_days must not be negative, got %d", c.History.RetentionDays))
+	}
+	if c.Cache.Enabled && backend != "postgres" && backend != "postgresql" {
+		errs = append(errs, errors.New("cache requires postgres storage"))
+	}
+	if c.Cache.Size < 1 {
+		errs = append(errs, fmt.Errorf("cache.size must be at least 1, got %d", c.Cache.Size))
+	}
+	if c.Cache.TTLMs < 0 {
+		errs = append(errs, fmt.Errorf("cache.ttl_ms must not be negative, got %d", c.Cache.TTLMs))
+	}
+	if c.StorageLayers.ChaosLatencyMs < 0 {
+		errs = append(errs, fmt.Errorf("storage_layers.chaos_latency_ms must not be negative, got %d", c.StorageLayers.ChaosLatencyMs))
+	}
+	if r := c.StorageLayers.ChaosLatencyRate; r < 0 || r > 1 {
+		errs = append(errs, fmt.Errorf("storage_layers.chaos_latency_rate must be between 0 and 1, got %v", r))
+	}
+	if r := c.StorageLayers.ChaosErrorRate; r < 0 || r > 1 {
+		errs = append(errs, fmt.Errorf("storage_layers.chaos_error_rate must be between 0 and 1, got %v", r))
+	}
+	if err := c.Cluster.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Webhooks.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SnapshotKeep < 1 {
+		errs = append(errs, fmt.Errorf("snapshot_keep must be at least 1, got %d", c.SnapshotKeep))
+	}
+	if c.WALSyncMillis < 0 {
+		errs = append(errs, fmt.Errorf("wal_sync_ms must not be negative, got %d", c.WALSyncMillis))
+	}
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every problem at once
+func (c DB) Validate() error {
+	var errs []error
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"db.max_open_conns", c.MaxOpenConns},
+		{"db.max_idle_conns", c.MaxIdleConns},
+		{"db.conn_max_lifetime_s", c.ConnMaxLifetimeSec},
+		{"db.conn_max_idle_s", c.ConnMaxIdleSec},
+		{"db.statement_timeout_ms", c.StatementTimeoutMs},
+		{"db.retry_base_ms", c.RetryBaseMs},
+		{"db.retry_max_ms", c.RetryMaxMs},
+		{"db.breaker_threshold", c.BreakerThreshold},
+		{"db.breaker_cooldown_s", c.BreakerCooldownSec},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", f.name, f.value))
+		}
+	}
+	if c.RetryAttempts < 1 {
+		errs = append(errs, fmt.Errorf("db.retry_attempts must be at least 1, got %d", c.RetryAttempts))
+	}
+	if c.RetryMaxMs < c.RetryBaseMs {
+		errs = append(errs, fmt.Errorf("db.retry_max_ms must not be below db.retry_base_ms, got %d < %d", c.RetryMaxMs, c.RetryBaseMs))
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports every problem at once
+func (c Agent) Validate() error {
+	var errs []error
+	if err := validateAddress(c.Address); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ReportInterval <= 0 {
+		errs = append(errs, fmt.Errorf("report_interval must be positive, got %d", c.ReportInterval))
+	}
+	if c.PollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("poll_interval must be positive, got %d", c.PollInterval))
+	}
+	if c.ID == "" || strings.ContainsAny(c.ID, "/ ") {
+		errs = append(errs, fmt.Errorf("id must be non-empty without slashes or spaces, got %q", c.ID))
+	}
+	return errors.Join(errs...)
+}
+
+func validateAddress(address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("address %q: %w", address, err)
+	}
+	return nil
+}
+
+// String returns effective config with secrets redacted
+func (c Server) String() string {
+	c.Key = redactKey(c.Key)
+	c.AdminToken = redactKey(c.AdminToken)
+	c.Webhooks.Key = redactKey(c.Webhooks.Key)
+	c.DatabaseDSN = redactDSN(c.DatabaseDSN)
+	c.Storage = redactDSN(c.Storage)
+	type plain Server
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+// String returns effective config with secrets redacted
+func (c Agent) String() string {
+	c.Key = redactKey(c.Key)
+	type plain Agent
+	return fmt.Sprintf("%+v", plain(c))
+}
+
+func redactKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return redacted
+}
+
+// hides password of url or key=value style dsn
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.Opaque == "" {
+		return u.Redacted()
+	}
+	fields := strings.Fields(dsn)
+	for i, f := range fields {
+		if strings.HasPrefix(f, "password=") {
+			fields[i] = "password=" + redacted
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// splits a comma separated flag, blanks are dropped
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ReloadResult describes the latest config reload
+type ReloadResult struct {
+	At              time.Time `json:"at"`
+	OK              bool      `json:"ok"`
+	Error           string    `json:"error,omitempty"`
+	Applied         []string  `json:"applied,omitempty"`          // settings changed at runtime
+	RestartRequired []string  `json:"restart_required,omitempty"` // changed, but ignored until restart
+}
+
+// Store holds the current config and swaps it atomically on reload
+type Store[T any] struct {
+	cur   atomic.Pointer[T]
+	load  func() (*T, error)
+	merge func(cur, next T) (T, []string, []string)
+
+	mu      sync.Mutex
+	last    ReloadResult
+	onApply []func(*T)
+}
+
+func NewServerStore(cfg *Server, args []string) *Store[Server] {
+	return newStore(cfg, func() (*Server, error) { return LoadServer(args) }, mergeServer)
+}
+
+func NewAgentStore(cfg *Agent, args []string) *Store[Agent] {
+	return newStore(cfg, func() (*Agent, error) { return LoadAgent(args) }, mergeAgent)
+}
+
+func newStore[T any](cfg *T, load func() (*T, error), merge func(cur, next T) (T, []string, []string)) *Store[T] {
+	s := &Store[T]{load: load, merge: merge}
+	s.cur.Store(cfg)
+	return s
+}
+
+// Get returns current config, it must not be modified
+func (s *Store[T]) Get() *T {
+	return s.cur.Load()
+}
+
+// OnApply registers fn to be called with the new config after every successful reload
+func (s *Store[T]) OnApply(fn func(*T)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onApply = append(s.onApply, fn)
+}
+
+// Reload loads and validates config again, runtime settings are applied
+// and restart-only changes are reported but ignored
+func (s *Store[T]) Reload() ReloadResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := ReloadResult{At: time.Now()}
+	next, err := s.load()
+	if err != nil {
+		result.Error = err.Error()
+		s.last = result
+		return result
+	}
+
+	merged, applied, restart := s.merge(*s.cur.Load(), *next)
+	s.cur.Store(&merged)
+	for _, fn := range s.onApply {
+		fn(&merged)
+	}
+
+	result.OK = true
+	result.Applied = applied
+	result.RestartRequired = restart
+	s.last = result
+	return result
+}
+
+func (s *Store[T]) LastReload() ReloadResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// WatchSIGHUP reloads config on every SIGHUP until ctx is done
+func (s *Store[T]) WatchSIGHUP(ctx context.Context, report func(ReloadResult)) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			report(s.Reload())
+		}
+	}
+}
+
+func mergeServer(cur, next Server) (Server, []string, []string) {
+	var applied, restart []string
+	merged := cur
+
+	if cur.LogLevel != next.LogLevel {
+		merged.LogLevel = next.LogLevel
+		applied = append(applied, "log_level")
+	}
+	if cur.Key != next.Key {
+		merged.Key = next.Key
+		applied = append(applied, "key")
+	}
+	if cur.StoreInterval != next.StoreInterval {
+		merged.StoreInterval = next.StoreInterval
+		applied = append(applied, "store_interval")
+	}
+	if cur.AdminToken != next.AdminToken {
+		merged.AdminToken = next.AdminToken
+		applied = append(applied, "admin_token")
+	}
+	if cur.BackupDir != next.BackupDir {
+		merged.BackupDir = next.BackupDir
+		applied = append(applied, "backup_dir")
+	}
+	if !slices.Equal(cur.Cluster.Nodes, next.Cluster.Nodes) {
+		merged.Cluster.Nodes = next.Cluster.Nodes
+		applied = append(applied, "cluster.nodes")
+	}
+
+	if cur.Address != next.Address {
+		restart = append(restart, "address")
+	}
+	if cur.FileStoragePath != next.FileStoragePath {
+		restart = append(restart, "file_storage_path")
+	}
+	if cur.Restore != next.Restore {
+		restart = append(restart, "restore")
+	}
+	if cur.Storage != next.Storage {
+		restart = append(restart, "storage")
+	}
+	if cur.DatabaseDSN != next.DatabaseDSN {
+		restart = append(restart, "database_dsn")
+	}
+	if cur.DatabaseDriver != next.DatabaseDriver {
+		restart = append(restart, "database_driver")
+	}
+	if cur.DB != next.DB {
+		restart = append(restart, "db")
+	}
+	if cur.History != next.History {
+		restart = append(restart, "history")
+	}
+	if cur.Cache != next.Cache {
+		restart = append(restart, "cache")
+	}
+	if cur.StorageLayers != next.StorageLayers {
+		restart = append(restart, "storage_layers")
+	}
+	if cur.Cluster.Self != next.Cluster.Self || cur.Cluster.NodesFile != next.Cluster.NodesFile ||
+		cur.Cluster.Replicas != next.Cluster.Replicas || cur.Cluster.RefreshSec != next.Cluster.RefreshSec {
+		restart = append(restart, "cluster")
+	}
+	if !reflect.DeepEqual(cur.Webhooks, next.Webhooks) {
+		restart = append(restart, "webhooks")
+	}
+	if cur.SnapshotKeep != next.SnapshotKeep {
+		restart = append(restart, "snapshot_keep")
+	}
+	if cur.SnapshotFormat != next.SnapshotFormat {
+		restart = append(restart, "snapshot_format")
+	}
+	if cur.WAL != next.WAL {
+		restart = append(restart, "wal")
+	}
+	if cur.WALSyncMillis != next.WALSyncMillis {
+		restart = append(restart, "wal_sync_ms")
+	}
+	return merged, applied, restart
+}
+
+func mergeAgent(cur, next Agent) (Agent, []string, []string) {
+	var applied, restart []string
+	merged := cur
+
+	if cur.Key != next.Key {
+		merged.Key = next.Key
+		applied = append(applied, "key")
+	}
+	if cur.Gzip != next.Gzip {
+		merged.Gzip = next.Gzip
+		applied = append(applied, "gzip")
+	}
+	if cur.ReportInterval != next.ReportInterval {
+		merged.ReportInterval = next.ReportInterval
+		applied = append(applied, "report_interval")
+	}
+	if cur.PollInterval != next.PollInterval {
+		merged.PollInterval = next.PollInterval
+		applied = append(applied, "poll_interval")
+	}
+
+	if cur.Address != next.Address {
+		restart = append(restart, "address")
+	}
+	if cur.WebSocket != next.WebSocket {
+		restart = append(restart, "websocket")
+	}
+	if cur.ID != next.ID {
+		restart = append(restart, "id")
+	}
+	return merged, applied, restart
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreReload(t *testing.T) {
+	path := writeFile(t, "server.yaml", "key: old\nstore_interval: 10\n")
+	args := []string{"-c", path}
+
+	cfg, err := LoadServer(args)
+	require.NoError(t, err)
+	cfgs := NewServerStore(cfg, args)
+
+	var applied *Server
+	cfgs.OnApply(func(next *Server) { applied = next })
+
+	require.NoError(t, os.WriteFile(path, []byte("key: new\nstore_interval: 1\naddress: other:9090\nlog_level: warn\n"), 0600))
+	result := cfgs.Reload()
+	require.True(t, result.OK, result.Error)
+	assert.ElementsMatch(t, []string{"key", "store_interval", "log_level"}, result.Applied)
+	assert.Equal(t, []string{"address"}, result.RestartRequired)
+
+	// runtime settings swapped, address kept until restart
+	assert.Equal(t, "new", cfgs.Get().Key)
+	assert.Equal(t, 1, cfgs.Get().StoreInterval)
+	assert.Equal(t, "localhost:8080", cfgs.Get().Address)
+	assert.Same(t, cfgs.Get(), applied)
+
+	// invalid config is not applied
+	require.NoError(t, os.WriteFile(path, []byte("store_interval: -5\nlog_level: loud\n"), 0600))
+	result = cfgs.Reload()
+	assert.False(t, result.OK)
+	assert.Contains(t, result.Error, "store_interval")
+	assert.Contains(t, result.Error, "log_level")
+	assert.Equal(t, "new", cfgs.Get().Key)
+	assert.Equal(t, result, cfgs.LastReload())
+}
+
+func TestStoreReloadClusterNodes(t *testing.T) {
+	path := writeFile(t, "server.yaml", "cluster:\n  self: http://a:8080\n  nodes: [http://a:8080]\n")
+	args := []string{"-c", path}
+	cfg, err := LoadServer(args)
+	require.NoError(t, err)
+	cfgs := NewServerStore(cfg, args)
+
+	require.NoError(t, os.WriteFile(path, []byte("cluster:\n  self: http://a:8080\n  nodes: [http://a:8080, http://b:8080]\n  replicas: 16\n"), 0600))
+	result := cfgs.Reload()
+	require.True(t, result.OK, result.Error)
+	assert.Equal(t, []string{"cluster.nodes"}, result.Applied)
+	assert.Equal(t, []string{"cluster"}, result.RestartRequired)
+	assert.Equal(t, []string{"http://a:8080", "http://b:8080"}, cfgs.Get().Cluster.Nodes)
+	assert.Equal(t, 128, cfgs.Get().Cluster.Replicas)
+}
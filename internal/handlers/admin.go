@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/config"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// ReloadStatus returns the result of the latest config reload
+func ReloadStatus(cfgs *config.Store[config.Server]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cfgs.LastReload())
+	}
+}
+
+// Reload re-reads config the same way SIGHUP does
+func Reload(cfgs *config.Store[config.Server]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result := cfgs.Reload()
+		if !result.OK {
+			c.JSON(http.StatusBadRequest, result)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// Snapshot exports all metrics to a new file in the backup dir,
+// format query parameter selects the codec.
+// Snapshot, Backup and Restore answer 501 in cluster mode, where a node holds only its own series
+func Snapshot(db storage.Database, dir func() string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		codec, err := storage.CodecFor(c.Query("format"), "")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := os.MkdirAll(dir(), 0755); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		path := filepath.Join(dir(), backupName(codec))
+		header, err := storage.ExportFile(c.Request.Context(), db, path, codec)
+		if err != nil {
+			snapshotError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"path": path, "snapshot": header})
+	}
+}
+
+// Backup streams a fresh export as a download
+func Backup(db storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		codec, err := storage.CodecFor(c.Query("format"), "")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tmp, err := os.MkdirTemp("", "metrics-backup-*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer os.RemoveAll(tmp)
+
+		name := backupName(codec)
+		path := filepath.Join(tmp, name)
+		if _, err := storage.ExportFile(c.Request.Context(), db, path, codec); err != nil {
+			snapshotError(c, err)
+			return
+		}
+		c.FileAttachment(path, name)
+	}
+}
+
+// Restore loads an uploaded snapshot of any format.
+// mode=merge (default) overwrites series present in the snapshot, mode=replace drops all others
+func Restore(db storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var replace bool
+		switch c.DefaultQuery("mode", "merge") {
+		case "merge":
+		case "replace":
+			replace = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be merge or replace"})
+			return
+		}
+
+		tmp, err := os.CreateTemp("", "metrics-restore-*")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, c.Request.Body)
+		tmp.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		header, err := storage.ImportFile(c.Request.Context(), db, tmp.Name(), replace)
+		if err != nil {
+			snapshotError(c, err)
+			return
+		}
+		logger.FromContext(c.Request.Context()).Info("restored snapshot", zap.Int("metrics", header.Count), zap.Bool("replace", replace))
+		c.JSON(http.StatusOK, gin.H{"restored": header.Count, "replace": replace, "snapshot": header})
+	}
+}
+
+func backupName(codec storage.SnapshotCodec) string {
+	return fmt.Sprintf("metrics-%s.%s", time.Now().UTC().Format("20060102T150405Z"), codec.Name())
+}
+
+// PoolStats reports the postgres connection pool, 501 for the memory backend
+func PoolStats(db storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := storage.Unwrap(db).(storage.PoolStatter)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "storage has no connection pool"})
+			return
+		}
+		c.JSON(http.StatusOK, s.PoolStats())
+	}
+}
+
+func snapshotError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, storage.ErrSnapshotUnsupported):
+		c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+	case errors.Is(err, storage.ErrCorruptSnapshot):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logger.FromContext(c.Request.Context()).Error("snapshot", zap.Error(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
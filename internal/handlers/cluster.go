@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/cluster"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// decodes series sent by another node
+func clusterMetrics(c *gin.Context) (collector.Metrics, bool) {
+	var metrics collector.Metrics
+	if err := c.ShouldBindJSON(&metrics); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	for _, metric := range metrics {
+		var err error
+		switch {
+		case metric.ID == "":
+			err = fmt.Errorf("metric without id")
+		case metric.MType == "gauge" && metric.Value == nil, metric.MType == "counter" && metric.Delta == nil:
+			err = fmt.Errorf("%s metric %q without value", metric.MType, metric.ID)
+		case metric.MType != "gauge" && metric.MType != "counter":
+			err = fmt.Errorf("unknown metric type: %s", metric.MType)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, false
+		}
+	}
+	return metrics, true
+}
+
+// ClusterUpdates stores series forwarded by another node in local storage, they are never forwarded again
+func ClusterUpdates(local storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metrics, ok := clusterMetrics(c)
+		if !ok {
+			return
+		}
+		if err := local.UpdateBatch(c.Request.Context(), metrics); err != nil {
+			logger.FromContext(c.Request.Context()).Error("error while storing forwarded metrics", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// ClusterValue returns a series from local storage
+func ClusterValue(local storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metric, err := local.Return(c.Request.Context(), c.Param("metricType"), c.Param("metricName"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, metric)
+	}
+}
+
+// ClusterHandoff adopts series another node no longer owns, a resent handoff is adopted once
+func ClusterHandoff(local storage.Database) gin.HandlerFunc {
+	handoffs := cluster.NewHandoffs()
+	return func(c *gin.Context) {
+		log := logger.FromContext(c.Request.Context())
+		metrics, ok := clusterMetrics(c)
+		if !ok {
+			return
+		}
+		id := c.GetHeader(cluster.HandoffHeader)
+		adopted, err := handoffs.Adopt(c.Request.Context(), local, id, metrics)
+		if err != nil {
+			log.Error("error while adopting metrics", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if adopted {
+			log.Info("adopted series", zap.Int("series", len(metrics)), zap.String("handoff", id))
+		} else {
+			log.Info("handoff already adopted", zap.String("handoff", id))
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// ClusterMembers shows the ring as this node sees it
+func ClusterMembers(cl *cluster.Cluster) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ring := cl.Ring()
+		c.JSON(http.StatusOK, gin.H{
+			"self":   cl.Self(),
+			"member": ring.Has(cl.Self()),
+			"nodes":  ring.Nodes(),
+		})
+	}
+}
@@ -2,127 +2,142 @@ package handlers
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/paranoiachains/metrics/internal/collector"
-	"github.com/paranoiachains/metrics/internal/flags"
 	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
 	"github.com/paranoiachains/metrics/internal/storage"
 	"go.uber.org/zap"
 )
 
 func urlHandle(c *gin.Context, metricType string, db storage.Database) {
+	log := logger.FromContext(c.Request.Context())
 	metricValue := c.Param("metricValue")
 	metricName := c.Param("metricName")
 
 	if metricValue == "" {
-		logger.Log.Error("error while extracting metric params")
+		log.Error("error while extracting metric params")
 		c.String(http.StatusNotFound, "")
 		return
 	}
+	if selfstats.Reserved(metricName) {
+		log.Error("reserved metric name", zap.String("metric id", metricName))
+		c.String(http.StatusBadRequest, "")
+		return
+	}
 
 	switch metricType {
 	case "gauge":
 		v, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
-			logger.Log.Error("error while parsing float metric val")
+			log.Error("error while parsing float metric val")
 			c.String(http.StatusBadRequest, "")
 			return
 		}
-		db.Update(context.Background(), "gauge", metricName, v)
+		db.Update(c.Request.Context(), "gauge", metricName, v)
 
 	case "counter":
 		v, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
-			logger.Log.Error("error while parsing int metric val")
+			log.Error("error while parsing int metric val")
 			c.String(http.StatusBadRequest, "")
 			return
 		}
-		db.Update(context.Background(), "counter", metricName, v)
+		db.Update(c.Request.Context(), "counter", metricName, v)
 	}
 	c.String(http.StatusOK, "")
 }
 
 // URLUpdate is a Gin route handler for POST HTTP metric updates
-func URLUpdate() gin.HandlerFunc {
+func URLUpdate(db storage.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Param("metricType") != "gauge" && c.Param("metricType") != "counter" {
-			logger.Log.Error("invalid metric type")
+			logger.FromContext(c.Request.Context()).Error("invalid metric type")
 			c.String(http.StatusBadRequest, "")
 			return
 		}
-		urlHandle(c, c.Param("metricType"), storage.CurrentStorage)
+		urlHandle(c, c.Param("metricType"), db)
 	}
 }
 
 // return metric value from storage
-func URLValue(c *gin.Context) {
+func urlValue(c *gin.Context, db storage.Database) {
+	log := logger.FromContext(c.Request.Context())
 	metricType := c.Param("metricType")
 	metricName := c.Param("metricName")
 
+	if metricType != "gauge" && metricType != "counter" {
+		log.Error("invalid metric type")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+
+	metric, err := db.Return(c.Request.Context(), metricType, metricName)
+	if err != nil {
+		log.Error("no such metric", zap.Error(err))
+		c.String(http.StatusNotFound, "")
+		return
+	}
+
 	switch metricType {
 	case "gauge":
-		retrievedName, ok := storage.Storage.Gauge[metricName]
-		if !ok {
-			logger.Log.Error("no such metric")
-			c.String(http.StatusNotFound, "")
-			return
-		}
-		c.String(200, strconv.FormatFloat(retrievedName, 'g', -1, 64))
-
+		c.String(http.StatusOK, strconv.FormatFloat(*metric.Value, 'g', -1, 64))
 	case "counter":
-		retrievedName, ok := storage.Storage.Counter[metricName]
-		if !ok {
-			logger.Log.Error("no such metric")
-			c.String(http.StatusNotFound, "")
-			return
-		}
-		logger.Log.Sugar().Infof("sent response: %d", http.StatusOK)
-		c.String(200, strconv.FormatInt(retrievedName, 10))
+		c.String(http.StatusOK, strconv.FormatInt(*metric.Delta, 10))
+	}
+}
 
-	default:
-		logger.Log.Error("invalid metric type")
-		c.String(http.StatusBadRequest, "")
+// URLValue is a Gin route handler for GET HTTP metric values
+func URLValue(db storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		urlValue(c, db)
 	}
 }
 
 // jsonHandle changes the value of global storage and returns a status code
 func jsonHandle(c *gin.Context, db storage.Database) {
+	log := logger.FromContext(c.Request.Context())
 	var buf bytes.Buffer
 	var metric collector.Metric
 
 	_, err := buf.ReadFrom(c.Request.Body)
-	logger.Log.Info("request body:", zap.ByteString("body", buf.Bytes()))
+	log.Info("request body:", zap.ByteString("body", buf.Bytes()))
 	if err != nil {
-		logger.Log.Error("error while reading from request body", zap.Error(err))
+		log.Error("error while reading from request body", zap.Error(err))
 		c.String(http.StatusNotFound, "")
 		return
 	}
 	if err = json.Unmarshal(buf.Bytes(), &metric); err != nil {
-		logger.Log.Error("error while decoding json", zap.Error(err))
+		log.Error("error while decoding json", zap.Error(err))
 		c.String(http.StatusNotFound, "")
 		return
 	}
 	if metric.ID == "" {
-		logger.Log.Error("metric id not found", zap.String("metric id", metric.ID))
+		log.Error("metric id not found", zap.String("metric id", metric.ID))
 		c.String(http.StatusNotFound, "")
 		return
 	}
 	if metric.Delta == nil && metric.Value == nil {
-		logger.Log.Error("no metric value!")
+		log.Error("no metric value!")
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+	if selfstats.Reserved(metric.ID) {
+		log.Error("reserved metric name", zap.String("metric id", metric.ID))
 		c.String(http.StatusBadRequest, "")
 		return
 	}
 	switch metric.MType {
 	case "gauge":
-		db.Update(context.Background(), metric.MType, metric.ID, *metric.Value)
+		db.Update(c.Request.Context(), metric.MType, metric.ID, *metric.Value)
 	case "counter":
-		db.Update(context.Background(), metric.MType, metric.ID, *metric.Delta)
+		db.Update(c.Request.Context(), metric.MType, metric.ID, *metric.Delta)
 	default:
 		c.String(http.StatusBadRequest, "")
 	}
@@ -131,90 +146,132 @@ func jsonHandle(c *gin.Context, db storage.Database) {
 }
 
 // JSONUpdate is a Gin route handler for POST HTTP metric updates
-func JSONUpdate() gin.HandlerFunc {
+func JSONUpdate(db storage.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		jsonHandle(c, storage.CurrentStorage)
+		jsonHandle(c, db)
 	}
 }
 
 // return metric returnValue from storage
 func returnValue(c *gin.Context, db storage.Database) {
+	log := logger.FromContext(c.Request.Context())
 	var buf bytes.Buffer
 	var reqMetric collector.Metric
 
 	_, err := buf.ReadFrom(c.Request.Body)
-	logger.Log.Info("request body:", zap.ByteString("body", buf.Bytes()))
+	log.Info("request body:", zap.ByteString("body", buf.Bytes()))
 	if err != nil {
-		logger.Log.Error("error while reading from request body", zap.Error(err))
+		log.Error("error while reading from request body", zap.Error(err))
 		c.String(http.StatusInternalServerError, "")
 		return
 	}
 	if err = json.Unmarshal(buf.Bytes(), &reqMetric); err != nil {
-		logger.Log.Error("error while decoding json", zap.Error(err))
+		log.Error("error while decoding json", zap.Error(err))
 		c.String(http.StatusBadRequest, "")
 		return
 	}
-	logger.Log.Info("unmarshalled metric:", zap.Object("metric", reqMetric))
+	log.Info("unmarshalled metric:", zap.Object("metric", reqMetric))
 	if reqMetric.ID == "" {
-		logger.Log.Error("metric id not found", zap.String("metric id", reqMetric.ID))
+		log.Error("metric id not found", zap.String("metric id", reqMetric.ID))
 		c.String(http.StatusNotFound, "")
 		return
 	}
-	respMetric, err := db.Return(context.Background(), reqMetric.MType, reqMetric.ID)
+	respMetric, err := db.Return(c.Request.Context(), reqMetric.MType, reqMetric.ID)
 	if err != nil {
-		logger.Log.Error("error while getting metric from db", zap.Error(err))
+		log.Error("error while getting metric from db", zap.Error(err))
 		c.String(http.StatusNotFound, "")
 		return
 	}
 	c.JSON(http.StatusOK, respMetric)
 }
 
-func JSONValue() gin.HandlerFunc {
+func JSONValue(db storage.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		returnValue(c, storage.CurrentStorage)
+		returnValue(c, db)
 	}
 }
 
 func batchUpdate(c *gin.Context, db storage.Database) {
+	log := logger.FromContext(c.Request.Context())
 	var buf bytes.Buffer
 	var reqMetrics collector.Metrics
 
 	_, err := buf.ReadFrom(c.Request.Body)
-	logger.Log.Info("request body:", zap.ByteString("body", buf.Bytes()))
+	log.Info("request body:", zap.ByteString("body", buf.Bytes()))
 	if err != nil {
-		logger.Log.Error("error while reading from request body", zap.Error(err))
+		log.Error("error while reading from request body", zap.Error(err))
 		c.String(http.StatusInternalServerError, "")
 		return
 	}
 	if err = json.Unmarshal(buf.Bytes(), &reqMetrics); err != nil {
-		logger.Log.Error("error while decoding json", zap.Error(err))
+		log.Error("error while decoding json", zap.Error(err))
 		c.String(http.StatusBadRequest, "")
 		return
 	}
 	for _, metric := range reqMetrics {
 		if metric.ID == "" {
-			logger.Log.Error("metric id not found", zap.String("metric id", metric.ID))
+			log.Error("metric id not found", zap.String("metric id", metric.ID))
 			c.String(http.StatusNotFound, "")
 			return
 		}
 		if metric.Delta == nil && metric.Value == nil {
-			logger.Log.Error("no metric value!")
+			log.Error("no metric value!")
+			c.String(http.StatusBadRequest, "")
+			return
+		}
+		if selfstats.Reserved(metric.ID) {
+			log.Error("reserved metric name", zap.String("metric id", metric.ID))
 			c.String(http.StatusBadRequest, "")
 			return
 		}
 	}
-	err = db.UpdateBatch(context.Background(), reqMetrics)
+	stats := selfstats.FromContext(c.Request.Context())
+	stats.Inc("http.batch.requests", 1)
+	stats.Inc("http.batch.metrics", int64(len(reqMetrics)))
+	stats.Set("http.batch.last_size", float64(len(reqMetrics)))
+	err = db.UpdateBatch(c.Request.Context(), reqMetrics)
 	if err != nil {
-		logger.Log.Error("error while batch updating", zap.Error(err))
+		log.Error("error while batch updating", zap.Error(err))
 		c.String(http.StatusInternalServerError, "")
 		return
 	}
 	c.JSON(http.StatusOK, reqMetrics)
 }
 
-func JSONBatch() gin.HandlerFunc {
+func JSONBatch(db storage.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		batchUpdate(c, storage.CurrentStorage)
+		batchUpdate(c, db)
+	}
+}
+
+// stream pushes metric updates as Server-Sent Events,
+// optionally filtered by "prefix" and "type" query params
+func stream(c *gin.Context, events *storage.Hub) {
+	sub := events.Subscribe(c.Query("prefix"), c.Query("type"))
+	defer events.Unsubscribe(sub)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case metric, ok := <-sub.C:
+			if !ok {
+				// dropped as a slow consumer
+				logger.FromContext(c.Request.Context()).Info("sse subscriber dropped")
+				return false
+			}
+			c.SSEvent("metric", metric)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Stream is a Gin route handler for live updates of series
+func Stream(events *storage.Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stream(c, events)
 	}
 }
 
@@ -233,14 +290,20 @@ func HTMLReturnAll(c *gin.Context) {
 		</html>`)
 }
 
-func Ping(c *gin.Context) {
-	databaseDSN := flags.DBEndpoint
-	db, err := storage.ConnectAndPing("pgx", databaseDSN)
-	if err != nil {
-		logger.Log.Fatal("error while connecting to db", zap.Error(err))
-		c.String(http.StatusInternalServerError, "")
-		return
+// Ping checks the database using the existing connection pool
+func Ping(db storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logger.FromContext(c.Request.Context())
+		if _, ok := storage.Unwrap(db).(storage.PoolStatter); !ok {
+			log.Error("ping: no database configured")
+			c.String(http.StatusInternalServerError, "")
+			return
+		}
+		if err := storage.Ping(c.Request.Context(), db); err != nil {
+			log.Error("error while pinging db", zap.Error(err))
+			c.String(http.StatusInternalServerError, "")
+			return
+		}
+		c.String(http.StatusOK, "pong")
 	}
-	defer db.Close()
-	c.String(http.StatusOK, "pong")
 }
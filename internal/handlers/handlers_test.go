@@ -3,17 +3,22 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/paranoiachains/metrics/internal/collector"
 	"github.com/paranoiachains/metrics/internal/middleware"
 	"github.com/paranoiachains/metrics/internal/mocks"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/mock/gomock"
+	"go.uber.org/zap"
 )
 
 func TestMetricHandler(t *testing.T) {
@@ -117,7 +122,7 @@ func TestMetricHandler(t *testing.T) {
 			}
 
 			r := gin.New()
-			r.Use(gin.Recovery(), middleware.LoggerMiddleware(), middleware.GzipMiddleware())
+			r.Use(gin.Recovery(), middleware.LoggerMiddleware(zap.NewNop()), middleware.GzipMiddleware())
 
 			r.POST("/update/:metricType/:metricName/:metricValue", func(c *gin.Context) {
 				if c.Param("metricType") != "gauge" && c.Param("metricType") != "counter" {
@@ -255,7 +260,7 @@ func TestJSONValue(t *testing.T) {
 			}
 
 			r := gin.New()
-			r.Use(gin.Recovery(), middleware.LoggerMiddleware(), middleware.GzipMiddleware())
+			r.Use(gin.Recovery(), middleware.LoggerMiddleware(zap.NewNop()), middleware.GzipMiddleware())
 
 			r.POST("/update/", func(c *gin.Context) {
 				jsonHandle(c, mockStorage)
@@ -292,3 +297,83 @@ func TestJSONValue(t *testing.T) {
 		})
 	}
 }
+
+func TestWSUpdates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockDatabase(ctrl)
+	mockStorage.EXPECT().UpdateBatch(gomock.Any(), gomock.Len(2)).Return(nil).Times(2)
+
+	r := gin.New()
+	r.GET("/ws/updates", func(c *gin.Context) {
+		wsUpdates(c, mockStorage, "", newWSSessions())
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	v := 1.5
+	d := int64(3)
+	metrics := collector.Metrics{
+		{ID: "Alloc", MType: "gauge", Value: &v},
+		{ID: "PollCount", MType: "counter", Delta: &d},
+	}
+
+	client := collector.NewWSClient(strings.TrimPrefix(srv.URL, "http://"), "")
+	defer client.Close()
+
+	// both frames go over the same connection
+	assert.NoError(t, client.Send(metrics))
+	assert.NoError(t, client.Send(metrics))
+
+	// invalid frame is rejected but keeps the connection open
+	err := client.Send(collector.Metrics{{ID: "", MType: "gauge", Value: &v}})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, collector.ErrWSUnavailable)
+}
+
+func TestWSUpdatesDedupsResentFrames(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStorage := mocks.NewMockDatabase(ctrl)
+	mockStorage.EXPECT().UpdateBatch(gomock.Any(), gomock.Len(1)).Return(nil).Times(2)
+
+	r := gin.New()
+	r.GET("/ws/updates", WSUpdates(mockStorage, func() string { return "" }))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/updates"
+	metrics, _ := json.Marshal(collector.Metrics{{ID: "PollCount", MType: "counter", Delta: new(int64)}})
+	frames := []collector.Frame{
+		{Agent: "a", Seq: 1, Metrics: metrics},
+		{Agent: "a", Seq: 1, Metrics: metrics}, // resent after a lost ack, on a new connection
+		{Agent: "a", Seq: 2, Metrics: metrics},
+	}
+	for _, frame := range frames {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteJSON(frame))
+		var ack collector.Ack
+		assert.NoError(t, conn.ReadJSON(&ack))
+		assert.Equal(t, collector.Ack{Seq: frame.Seq, Status: "ok"}, ack)
+		conn.Close()
+	}
+}
+
+func TestWSSessionsBounded(t *testing.T) {
+	sessions := newWSSessions()
+	// every agent is active, none is old enough to expire
+	for i := 0; i < wsMaxSessions+10; i++ {
+		sessions.get(fmt.Sprintf("agent-%d", i))
+		assert.LessOrEqual(t, len(sessions.m), wsMaxSessions)
+	}
+
+	// the least recently used session makes room
+	sessions.m["agent-20"].seen = time.Now().Add(-time.Minute)
+	sessions.get("new")
+	assert.Len(t, sessions.m, wsMaxSessions)
+	assert.NotContains(t, sessions.m, "agent-20")
+	assert.Contains(t, sessions.m, "new")
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/health"
+)
+
+// Healthz reports that the process is alive
+func Healthz(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// Readyz reports whether the server can serve requests
+func Readyz(checker *health.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ready := checker.Run(c.Request.Context()); !ready {
+			c.String(http.StatusServiceUnavailable, "not ready")
+			return
+		}
+		c.String(http.StatusOK, "ok")
+	}
+}
+
+// HealthDetails returns every check with its latency and last error
+func HealthDetails(checker *health.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		results, ready := checker.Run(c.Request.Context())
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{
+			"ready":         ready,
+			"shutting_down": checker.ShuttingDown(),
+			"checks":        results,
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+// default range of History without from
+const historyWindow = time.Hour
+
+// History returns samples of a series, from and to are RFC 3339 and default to the last hour
+func History(db storage.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metricType := c.Param("metricType")
+		metricName := c.Param("metricName")
+		if metricType != "gauge" && metricType != "counter" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric type"})
+			return
+		}
+
+		to := time.Now()
+		if v := c.Query("to"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "to: " + err.Error()})
+				return
+			}
+			to = t
+		}
+		from := to.Add(-historyWindow)
+		if v := c.Query("from"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "from: " + err.Error()})
+				return
+			}
+			from = t
+		}
+		if !from.Before(to) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+			return
+		}
+
+		samples, err := storage.Range(c.Request.Context(), db, metricType, metricName, from, to)
+		if errors.Is(err, storage.ErrHistoryUnsupported) {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Error("error while reading history", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if samples == nil {
+			samples = []storage.Sample{}
+		}
+		c.JSON(http.StatusOK, samples)
+	}
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"go.uber.org/zap"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// sessions idle for longer than this are forgotten once the table is full,
+// if it is still full the least recently used one is dropped
+const (
+	wsSessionTTL  = time.Hour
+	wsMaxSessions = 1024
+)
+
+// wsSession is the last frame applied for one agent
+type wsSession struct {
+	mu   sync.Mutex
+	seq  int64
+	seen time.Time
+}
+
+// wsSessions remembers applied frames across reconnects, so a frame
+// resent after a lost ack is acknowledged without being applied twice
+type wsSessions struct {
+	mu sync.Mutex
+	m  map[string]*wsSession
+}
+
+func newWSSessions() *wsSessions {
+	return &wsSessions{m: make(map[string]*wsSession)}
+}
+
+func (s *wsSessions) get(agent string) *wsSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.m[agent]
+	if ok {
+		return sess
+	}
+	if len(s.m) >= wsMaxSessions {
+		s.evict()
+	}
+	sess = &wsSession{seen: time.Now()}
+	s.m[agent] = sess
+	return sess
+}
+
+// evict forgets idle sessions, if none are idle the least recently used one goes
+func (s *wsSessions) evict() {
+	var lru string
+	var lruSeen time.Time
+	for id, old := range s.m {
+		old.mu.Lock()
+		seen := old.seen
+		old.mu.Unlock()
+		if time.Since(seen) > wsSessionTTL {
+			delete(s.m, id)
+			continue
+		}
+		if lru == "" || seen.Before(lruSeen) {
+			lru, lruSeen = id, seen
+		}
+	}
+	if len(s.m) >= wsMaxSessions {
+		delete(s.m, lru)
+	}
+}
+
+// apply applies frame unless the agent's session already has it
+func (s *wsSessions) apply(ctx context.Context, db storage.Database, key string, frame collector.Frame) error {
+	if frame.Agent == "" {
+		return applyFrame(ctx, db, key, frame)
+	}
+	sess := s.get(frame.Agent)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.seen = time.Now()
+	if frame.Seq <= sess.seq {
+		return nil
+	}
+	if err := applyFrame(ctx, db, key, frame); err != nil {
+		return err
+	}
+	sess.seq = frame.Seq
+	return nil
+}
+
+// wsUpdates reads metric frames from a long-lived agent connection
+// and acknowledges every frame separately
+func wsUpdates(c *gin.Context, db storage.Database, key string, sessions *wsSessions) {
+	log := logger.FromContext(c.Request.Context())
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// upgrader has already replied with an error status
+		log.Error("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	for {
+		var frame collector.Frame
+		if err := conn.ReadJSON(&frame); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Error("error while reading websocket frame", zap.Error(err))
+			}
+			return
+		}
+
+		ack := collector.Ack{Seq: frame.Seq, Status: "ok"}
+		if err := sessions.apply(c.Request.Context(), db, key, frame); err != nil {
+			log.Error("websocket frame rejected", zap.Int64("seq", frame.Seq), zap.Error(err))
+			ack.Status = "error"
+			ack.Error = err.Error()
+		}
+		if err := conn.WriteJSON(ack); err != nil {
+			log.Error("error while writing websocket ack", zap.Error(err))
+			return
+		}
+	}
+}
+
+func applyFrame(ctx context.Context, db storage.Database, key string, frame collector.Frame) error {
+	if frame.Hash != "" && key != "" {
+		clientHash, _ := hex.DecodeString(frame.Hash)
+		h := hmac.New(sha256.New, []byte(key))
+		h.Write(frame.Metrics)
+		if !hmac.Equal(h.Sum(nil), clientHash) {
+			return fmt.Errorf("invalid hash")
+		}
+	}
+
+	var metrics collector.Metrics
+	if err := json.Unmarshal(frame.Metrics, &metrics); err != nil {
+		return err
+	}
+	for _, metric := range metrics {
+		if metric.ID == "" {
+			return fmt.Errorf("metric id not found")
+		}
+		if metric.Delta == nil && metric.Value == nil {
+			return fmt.Errorf("no value for metric %s", metric.ID)
+		}
+		if selfstats.Reserved(metric.ID) {
+			return fmt.Errorf("reserved metric name %s", metric.ID)
+		}
+	}
+	return db.UpdateBatch(ctx, metrics)
+}
+
+// WSUpdates is a Gin route handler for websocket metric ingestion,
+// frames are verified with key if it is not empty
+func WSUpdates(db storage.Database, key func() string) gin.HandlerFunc {
+	sessions := newWSSessions()
+	return func(c *gin.Context) {
+		wsUpdates(c, db, key(), sessions)
+	}
+}
@@ -0,0 +1,98 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// per-check timeout
+const checkTimeout = 2 * time.Second
+
+type CheckFunc func(ctx context.Context) error
+
+// Result of the latest run of a check
+type Result struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Latency   string    `json:"latency"`
+	Error     string    `json:"error,omitempty"`      // error of the latest run
+	LastError string    `json:"last_error,omitempty"` // latest error ever seen
+	LastErrAt time.Time `json:"last_error_at,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs registered dependency checks for the readiness probe
+type Checker struct {
+	mu           sync.Mutex
+	checks       []check
+	results      map[string]Result
+	shuttingDown atomic.Bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{results: make(map[string]Result)}
+}
+
+func (c *Checker) Register(name string, fn CheckFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// SetShuttingDown makes the checker report not ready from now on
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+func (c *Checker) ShuttingDown() bool {
+	return c.shuttingDown.Load()
+}
+
+// Run executes all checks and reports whether the server is ready
+func (c *Checker) Run(ctx context.Context) ([]Result, bool) {
+	c.mu.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.Unlock()
+
+	ready := !c.ShuttingDown()
+	results := make([]Result, 0, len(checks))
+	for _, ch := range checks {
+		r := c.run(ctx, ch)
+		if !r.Healthy {
+			ready = false
+		}
+		results = append(results, r)
+	}
+	return results, ready
+}
+
+func (c *Checker) run(ctx context.Context, ch check) Result {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := ch.fn(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.results[ch.name]
+	r.Name = ch.name
+	r.Healthy = err == nil
+	r.Latency = time.Since(start).String()
+	r.CheckedAt = start
+	r.Error = ""
+	if err != nil {
+		r.Error = err.Error()
+		r.LastError = err.Error()
+		r.LastErrAt = start
+	}
+	c.results[ch.name] = r
+	return r
+}
@@ -0,0 +1,38 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	c := NewChecker()
+
+	var dbErr error
+	c.Register("storage", func(ctx context.Context) error { return dbErr })
+	c.Register("persistence", func(ctx context.Context) error { return nil })
+
+	results, ready := c.Run(context.Background())
+	assert.True(t, ready)
+	assert.Len(t, results, 2)
+
+	dbErr = errors.New("connection refused")
+	results, ready = c.Run(context.Background())
+	assert.False(t, ready)
+	assert.False(t, results[0].Healthy)
+	assert.Equal(t, "connection refused", results[0].Error)
+
+	// recovered, but the last error is kept
+	dbErr = nil
+	results, ready = c.Run(context.Background())
+	assert.True(t, ready)
+	assert.Empty(t, results[0].Error)
+	assert.Equal(t, "connection refused", results[0].LastError)
+
+	c.SetShuttingDown()
+	_, ready = c.Run(context.Background())
+	assert.False(t, ready)
+}
@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -9,9 +11,41 @@ import (
 
 var Log *zap.Logger = zap.NewNop()
 
+// Level can be changed at runtime, every logger built by Initialize shares it
+var Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+type ctxKey struct{}
+
+// WithContext returns ctx carrying log, code running under it logs through
+// FromContext so that several servers in one process keep their own loggers
+func WithContext(ctx context.Context, log *zap.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, log)
+}
+
+// FromContext returns the logger put into ctx by WithContext, Log if there is none
+func FromContext(ctx context.Context) *zap.Logger {
+	if log, ok := ctx.Value(ctxKey{}).(*zap.Logger); ok {
+		return log
+	}
+	return Log
+}
+
+// Or returns log, Log if it is nil
+func Or(log *zap.Logger) *zap.Logger {
+	if log == nil {
+		return Log
+	}
+	return log
+}
+
+// SetLevel changes log level, e.g. "info"
+func SetLevel(level string) error {
+	return Level.UnmarshalText([]byte(level))
+}
+
 func Initialize() error {
 	cfg := zap.Config{
-		Level:       zap.NewAtomicLevelAt(zap.DebugLevel),
+		Level:       Level,
 		Development: true,
 		Sampling: &zap.SamplingConfig{
 			Initial:    100,
@@ -8,19 +8,22 @@ import (
 	"encoding/hex"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/paranoiachains/metrics/internal/flags"
 	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
 	"go.uber.org/zap"
 )
 
-func LoggerMiddleware() gin.HandlerFunc {
-	logger.Initialize()
-	defer logger.Log.Sync()
+// LoggerMiddleware logs every request to log and puts log into the request
+// context, handlers and storage below it log through logger.FromContext
+func LoggerMiddleware(log *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context(), log))
+
 		start := time.Now()
 		path := c.Request.URL.Path
 		method := c.Request.Method
@@ -30,19 +33,39 @@ func LoggerMiddleware() gin.HandlerFunc {
 
 		duration := time.Since(start)
 
-		logger.Log.Info("HTTP Request",
+		log.Info("HTTP Request",
 			zap.String("method", method),
 			zap.String("path", path),
 			zap.Duration("duration", duration),
 			zap.String("Accept-Encoding", encoding),
 		)
-		logger.Log.Info("HTTP Response",
+		log.Info("HTTP Response",
 			zap.Int("status", c.Writer.Status()),
 			zap.String("Content-Type", c.Writer.Header().Get("Content-Type")),
 		)
 	}
 }
 
+// Instrument counts requests and records latency per route and status into stats,
+// which is also put into the request context for handlers and storage below it
+func Instrument(stats *selfstats.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(selfstats.WithContext(c.Request.Context(), stats))
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		name := selfstats.Name("http", c.Request.Method, route)
+		status := strconv.Itoa(c.Writer.Status())
+		stats.Inc(name+".requests."+status, 1)
+		stats.Observe(name+".latency", time.Since(start))
+	}
+}
+
 func shouldCompress(req *http.Request) bool {
 	return strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
 }
@@ -53,14 +76,28 @@ func shouldDecompress(req *http.Request) bool {
 
 func GzipMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		log := logger.FromContext(c.Request.Context())
+		stats := selfstats.FromContext(c.Request.Context())
 		if shouldDecompress(c.Request) {
-			r, _ := gzip.NewReader(c.Request.Body)
+			r, err := gzip.NewReader(c.Request.Body)
+			if err != nil {
+				stats.Inc("gzip.errors", 1)
+				log.Error("gzip", zap.Error(err))
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
 			defer r.Close()
 
-			body, _ := io.ReadAll(r)
+			body, err := io.ReadAll(r)
+			if err != nil {
+				stats.Inc("gzip.errors", 1)
+				log.Error("gzip", zap.Error(err))
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
 			c.Request.Body = io.NopCloser(bytes.NewReader(body))
 			c.Request.Header.Del("Content-Encoding")
-			logger.Log.Info("gzip", zap.Bool("decompressed", true))
+			log.Info("gzip", zap.Bool("decompressed", true))
 		}
 		if !shouldCompress(c.Request) {
 			return
@@ -74,7 +111,7 @@ func GzipMiddleware() gin.HandlerFunc {
 			c.Header("Content-Length", "0")
 			gz.Close()
 		}()
-		logger.Log.Info("gzip", zap.Bool("compressed", true))
+		log.Info("gzip", zap.Bool("compressed", true))
 		c.Next()
 	}
 }
@@ -88,35 +125,75 @@ func (g *gzipWriter) Write(data []byte) (int, error) {
 	return g.writer.Write(data)
 }
 
-func shouldHash(r *http.Request) bool {
-	return r.Header.Get("HashSHA256") != "" && flags.ServerKey != ""
+// needed for streaming responses, otherwise gzip buffers until the handler returns
+func (g *gzipWriter) Flush() {
+	g.writer.Flush()
+	g.ResponseWriter.Flush()
 }
 
-func Hash() gin.HandlerFunc {
+func shouldHash(r *http.Request, key string) bool {
+	return r.Header.Get("HashSHA256") != "" && key != ""
+}
+
+// Hash verifies HashSHA256 header, key is read on every request so it can change at runtime
+func Hash(key func() string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if shouldHash(c.Request) {
+		key := key()
+		log := logger.FromContext(c.Request.Context())
+		if shouldHash(c.Request, key) {
 			clientHashHex := c.Request.Header.Get("HashSHA256")
 			clientHash, _ := hex.DecodeString(clientHashHex)
 
 			body, err := io.ReadAll(c.Request.Body)
 			if err != nil {
-				logger.Log.Error("hashsha256", zap.Error(err))
+				log.Error("hashsha256", zap.Error(err))
 				c.AbortWithStatus(http.StatusBadRequest)
 				return
 			}
 			c.Request.Body = io.NopCloser(bytes.NewReader(body))
 
-			h := hmac.New(sha256.New, []byte(flags.ServerKey))
+			h := hmac.New(sha256.New, []byte(key))
 			h.Write(body)
 			serverHash := h.Sum(nil)
 			if hmac.Equal(serverHash, []byte(clientHash)) {
-				logger.Log.Info("hashsha256", zap.Bool("valid", true))
+				log.Info("hashsha256", zap.Bool("valid", true))
 				c.Header("HashSHA256", clientHashHex)
 			} else {
-				logger.Log.Info("hashsha256", zap.Bool("valid", false))
+				log.Info("hashsha256", zap.Bool("valid", false))
+				selfstats.FromContext(c.Request.Context()).Inc("hmac.failures", 1)
 				c.AbortWithStatus(http.StatusBadRequest)
 			}
 		}
 		c.Next()
 	}
 }
+
+// RequireSignature rejects unsigned requests while a key is set, Hash verifies signed ones
+func RequireSignature(key func() string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key() != "" && c.GetHeader("HashSHA256") == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminAuth requires "Authorization: Bearer <token>", admin endpoints are disabled while token is empty
+func AdminAuth(token func() string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := token()
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin endpoints are disabled, set admin_token"})
+			return
+		}
+		given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || !hmac.Equal([]byte(given), []byte(token)) {
+			selfstats.FromContext(c.Request.Context()).Inc("admin.auth_failures", 1)
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
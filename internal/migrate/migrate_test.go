@@ -0,0 +1,101 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSource(t *testing.T, path string, series int) {
+	s := storage.NewMemStorage()
+	for i := 0; i < series; i++ {
+		require.NoError(t, s.Update(context.Background(), "counter", fmt.Sprintf("c%d", i), int64(i)))
+		require.NoError(t, s.Update(context.Background(), "gauge", fmt.Sprintf("g%d", i), float64(i)/2))
+	}
+	require.NoError(t, s.Write(path))
+}
+
+func TestMigrateFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "metrics-db.json")
+	writeSource(t, src, 50)
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{name: "json", target: "file:copy.json"},
+		{name: "protobuf", target: "file:copy.pb"},
+		{name: "kv", target: "kv:copy-kv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, path, _ := strings.Cut(tt.target, ":")
+			dst := filepath.Join(dir, path)
+			opts := Options{From: "file:" + src, To: scheme + ":" + dst, BatchSize: 7}
+
+			dry := opts
+			dry.DryRun = true
+			result, err := Run(context.Background(), dry)
+			require.NoError(t, err)
+			assert.Equal(t, 100, result.Total)
+			assert.NoFileExists(t, dst)
+
+			result, err = Run(context.Background(), opts)
+			require.NoError(t, err)
+			assert.True(t, result.Verified)
+			assert.Equal(t, 100, result.Copied)
+			assert.Equal(t, result.SourceChecksum, result.TargetChecksum)
+
+			// copying again changes nothing, counters are not added twice
+			result, err = Run(context.Background(), opts)
+			require.NoError(t, err)
+			assert.Equal(t, 100, result.Existing)
+			assert.Equal(t, result.SourceChecksum, result.TargetChecksum)
+		})
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "metrics-db.json")
+	writeSource(t, src, 50)
+	opts := Options{
+		From:      "file:" + src,
+		To:        "file:" + filepath.Join(dir, "copy.gob"),
+		BatchSize: 10,
+		StateFile: filepath.Join(dir, "state.json"),
+	}
+
+	// interrupted after the third batch
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := opts
+	interrupted.Progress = func(done, total int) {
+		if done == 30 {
+			cancel()
+		}
+	}
+	_, err := Run(ctx, interrupted)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.FileExists(t, opts.StateFile)
+
+	result, err := Run(context.Background(), opts)
+	require.NoError(t, err)
+	assert.Equal(t, 30, result.Resumed)
+	assert.Equal(t, 70, result.Copied)
+	assert.True(t, result.Verified)
+	assert.NoFileExists(t, opts.StateFile)
+}
+
+func TestOpenRejectsUnknownScheme(t *testing.T) {
+	_, err := Open("mysql://localhost/metrics", true)
+	assert.Error(t, err)
+	_, err = Open("file:", true)
+	assert.Error(t, err)
+}
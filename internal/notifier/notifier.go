@@ -0,0 +1,259 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/logger"
+	"go.uber.org/zap"
+)
+
+// alert states
+const (
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// single alert state change
+type Notification struct {
+	Rule   string            `json:"rule"`
+	State  string            `json:"state"`
+	Metric string            `json:"metric"`
+	Value  float64           `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+	At     time.Time         `json:"at"`
+}
+
+// body of a webhook request, notifications are grouped per rule
+type Payload struct {
+	Rule          string         `json:"rule"`
+	Notifications []Notification `json:"notifications"`
+}
+
+type Config struct {
+	URLs        []string      // webhook receivers
+	Key         string        // HMAC key, payload is not signed if empty
+	GroupWait   time.Duration // how long to collect notifications of one rule before sending
+	MaxAttempts int           // delivery attempts per receiver
+	Backoff     time.Duration // first retry delay, doubled on every attempt
+	Timeout     time.Duration // per request timeout
+}
+
+// Dispatcher groups, deduplicates and delivers notifications to webhooks
+type Dispatcher struct {
+	cfg    Config
+	client *http.Client
+
+	mu      sync.Mutex
+	pending map[string]map[string]Notification // rule -> metric -> latest notification
+	sent    map[string]map[string]string       // url -> rule/metric -> last state delivered there
+	timers  map[string]*time.Timer
+	wg      sync.WaitGroup
+	closed  bool
+	done    chan struct{} // closed by Close, aborts retry backoff
+}
+
+func NewDispatcher(cfg Config) *Dispatcher {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 4
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	return &Dispatcher{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		pending: make(map[string]map[string]Notification),
+		sent:    make(map[string]map[string]string),
+		timers:  make(map[string]*time.Timer),
+		done:    make(chan struct{}),
+	}
+}
+
+// Notify queues a notification; it is sent after GroupWait together
+// with the other notifications of the same rule. a state every receiver already
+// got is dropped, a receiver that failed gets it again with the next Notify
+func (d *Dispatcher) Notify(n Notification) {
+	if n.At.IsZero() {
+		n.At = time.Now()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+
+	// same state was already delivered everywhere, nothing changed
+	if d.deliveredEverywhere(n) {
+		if group, ok := d.pending[n.Rule]; ok {
+			delete(group, n.Metric)
+		}
+		return
+	}
+
+	group, ok := d.pending[n.Rule]
+	if !ok {
+		group = make(map[string]Notification)
+		d.pending[n.Rule] = group
+	}
+	group[n.Metric] = n
+
+	if _, ok := d.timers[n.Rule]; !ok {
+		rule := n.Rule
+		d.wg.Add(1)
+		d.timers[rule] = time.AfterFunc(d.cfg.GroupWait, func() {
+			defer d.wg.Done()
+			d.flush(rule)
+		})
+	}
+}
+
+func (d *Dispatcher) deliveredEverywhere(n Notification) bool {
+	for _, url := range d.cfg.URLs {
+		if d.sent[url][n.Rule+"/"+n.Metric] != n.State {
+			return false
+		}
+	}
+	return true
+}
+
+// Close delivers everything still pending and waits for in-flight deliveries;
+// pending retries are abandoned, so every receiver gets at most one more attempt
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+	}
+	var rules []string
+	for rule, t := range d.timers {
+		if t.Stop() {
+			d.wg.Done()
+			rules = append(rules, rule)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, rule := range rules {
+		d.flush(rule)
+	}
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) flush(rule string) {
+	d.mu.Lock()
+	group := d.pending[rule]
+	delete(d.pending, rule)
+	delete(d.timers, rule)
+	d.mu.Unlock()
+
+	if len(group) == 0 {
+		return
+	}
+	var all []Notification
+	for _, n := range group {
+		all = append(all, n)
+	}
+	// stable order so identical sends produce identical bodies
+	sort.Slice(all, func(i, j int) bool { return all[i].Metric < all[j].Metric })
+
+	// every receiver gets what it has not got yet
+	for _, url := range d.cfg.URLs {
+		payload := Payload{Rule: rule}
+		d.mu.Lock()
+		for _, n := range all {
+			if d.sent[url][rule+"/"+n.Metric] != n.State {
+				payload.Notifications = append(payload.Notifications, n)
+			}
+		}
+		d.mu.Unlock()
+		if len(payload.Notifications) == 0 {
+			continue
+		}
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			logger.Log.Error("webhook", zap.Error(err))
+			return
+		}
+		if err := d.deliver(url, body); err != nil {
+			logger.Log.Error("webhook", zap.String("url", url), zap.Error(err))
+			continue
+		}
+
+		d.mu.Lock()
+		sent, ok := d.sent[url]
+		if !ok {
+			sent = make(map[string]string)
+			d.sent[url] = sent
+		}
+		for _, n := range payload.Notifications {
+			sent[rule+"/"+n.Metric] = n.State
+		}
+		d.mu.Unlock()
+	}
+}
+
+// POST with exponential backoff
+func (d *Dispatcher) deliver(url string, body []byte) error {
+	var lastErr error
+	delay := d.cfg.Backoff
+	for attempt := 0; attempt < d.cfg.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-d.done:
+				t.Stop()
+				return fmt.Errorf("delivery aborted after %d attempts: %w", attempt, lastErr)
+			}
+			delay *= 2
+		}
+		if lastErr = d.post(url, body); lastErr == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("delivery failed after %d attempts: %w", d.cfg.MaxAttempts, lastErr)
+}
+
+func (d *Dispatcher) post(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// same signature scheme as middleware.Hash
+	if d.cfg.Key != "" {
+		h := hmac.New(sha256.New, []byte(d.cfg.Key))
+		h.Write(body)
+		req.Header.Set("HashSHA256", hex.EncodeToString(h.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad response! got %v", resp.StatusCode)
+	}
+	return nil
+}
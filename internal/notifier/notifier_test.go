@@ -0,0 +1,200 @@
+package notifier
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	payloads []Payload
+	fails    int
+}
+
+func (rc *receiver) handler(t *testing.T, key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		if key != "" {
+			h := hmac.New(sha256.New, []byte(key))
+			h.Write(body)
+			assert.Equal(t, hex.EncodeToString(h.Sum(nil)), r.Header.Get("HashSHA256"))
+		}
+
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		if rc.fails > 0 {
+			rc.fails--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var p Payload
+		require.NoError(t, json.Unmarshal(body, &p))
+		rc.payloads = append(rc.payloads, p)
+	}
+}
+
+func (rc *receiver) received() []Payload {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]Payload(nil), rc.payloads...)
+}
+
+func TestDispatcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		fails         int
+		notifications []Notification
+		wantPayloads  int
+		wantPerRule   map[string]int
+	}{
+		{
+			name: "grouped by rule",
+			notifications: []Notification{
+				{Rule: "high_alloc", State: StateFiring, Metric: "Alloc", Value: 1},
+				{Rule: "high_alloc", State: StateFiring, Metric: "HeapAlloc", Value: 2},
+				{Rule: "gc", State: StateFiring, Metric: "NumGC", Value: 3},
+			},
+			wantPayloads: 2,
+			wantPerRule:  map[string]int{"high_alloc": 2, "gc": 1},
+		},
+		{
+			name: "duplicates collapsed",
+			notifications: []Notification{
+				{Rule: "high_alloc", State: StateFiring, Metric: "Alloc", Value: 1},
+				{Rule: "high_alloc", State: StateFiring, Metric: "Alloc", Value: 5},
+			},
+			wantPayloads: 1,
+			wantPerRule:  map[string]int{"high_alloc": 1},
+		},
+		{
+			name:  "retried after failures",
+			fails: 2,
+			notifications: []Notification{
+				{Rule: "gc", State: StateResolved, Metric: "NumGC", Value: 3},
+			},
+			wantPayloads: 1,
+			wantPerRule:  map[string]int{"gc": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{fails: tt.fails}
+			srv := httptest.NewServer(rc.handler(t, "secret"))
+			defer srv.Close()
+
+			d := NewDispatcher(Config{
+				URLs:      []string{srv.URL},
+				Key:       "secret",
+				GroupWait: 20 * time.Millisecond,
+				Backoff:   time.Millisecond,
+			})
+			for _, n := range tt.notifications {
+				d.Notify(n)
+			}
+			// Close abandons retries, let the grouped sends finish first
+			assert.Eventually(t, func() bool { return len(rc.received()) == tt.wantPayloads }, time.Second, 5*time.Millisecond)
+			d.Close()
+
+			payloads := rc.received()
+			assert.Len(t, payloads, tt.wantPayloads)
+			for _, p := range payloads {
+				assert.Len(t, p.Notifications, tt.wantPerRule[p.Rule])
+			}
+		})
+	}
+}
+
+func TestDispatcherSkipsDeliveredState(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc.handler(t, ""))
+	defer srv.Close()
+
+	d := NewDispatcher(Config{URLs: []string{srv.URL}, GroupWait: time.Millisecond})
+	d.Notify(Notification{Rule: "gc", State: StateFiring, Metric: "NumGC"})
+	assert.Eventually(t, func() bool { return len(rc.received()) == 1 }, time.Second, 5*time.Millisecond)
+
+	// still firing, receiver already knows
+	d.Notify(Notification{Rule: "gc", State: StateFiring, Metric: "NumGC"})
+	d.Notify(Notification{Rule: "gc", State: StateResolved, Metric: "NumGC"})
+	d.Close()
+
+	payloads := rc.received()
+	require.Len(t, payloads, 2)
+	assert.Equal(t, StateResolved, payloads[1].Notifications[0].State)
+}
+
+func TestDispatcherRetriesFailedReceiver(t *testing.T) {
+	ok, failing := &receiver{}, &receiver{fails: 1}
+	okSrv := httptest.NewServer(ok.handler(t, ""))
+	defer okSrv.Close()
+	failingSrv := httptest.NewServer(failing.handler(t, ""))
+	defer failingSrv.Close()
+
+	d := NewDispatcher(Config{URLs: []string{okSrv.URL, failingSrv.URL}, GroupWait: time.Millisecond, MaxAttempts: 1})
+	d.Notify(Notification{Rule: "gc", State: StateFiring, Metric: "NumGC"})
+	assert.Eventually(t, func() bool { return len(ok.received()) == 1 }, time.Second, 5*time.Millisecond)
+	require.Empty(t, failing.received())
+
+	// only the receiver that missed it gets the state again
+	d.Notify(Notification{Rule: "gc", State: StateFiring, Metric: "NumGC"})
+	d.Close()
+
+	assert.Len(t, ok.received(), 1)
+	payloads := failing.received()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, StateFiring, payloads[0].Notifications[0].State)
+}
+
+func TestDispatcherCloseAbortsBackoff(t *testing.T) {
+	rc := &receiver{fails: 100}
+	srv := httptest.NewServer(rc.handler(t, ""))
+	defer srv.Close()
+
+	d := NewDispatcher(Config{URLs: []string{srv.URL}, GroupWait: time.Millisecond, Backoff: time.Hour})
+	d.Notify(Notification{Rule: "gc", State: StateFiring, Metric: "NumGC"})
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		d.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on retry backoff")
+	}
+}
+
+func TestDispatcherSortsNotifications(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc.handler(t, ""))
+	defer srv.Close()
+
+	d := NewDispatcher(Config{URLs: []string{srv.URL}, GroupWait: time.Hour})
+	for _, m := range []string{"c", "a", "d", "b"} {
+		d.Notify(Notification{Rule: "r", State: StateFiring, Metric: m})
+	}
+	d.Close()
+
+	payloads := rc.received()
+	require.Len(t, payloads, 1)
+	var got []string
+	for _, n := range payloads[0].Notifications {
+		got = append(got, n.Metric)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, got)
+}
@@ -0,0 +1,7 @@
+-- baseline, matches the table created before migrations existed
+CREATE TABLE IF NOT EXISTS metrics (
+    id VARCHAR(255) PRIMARY KEY,
+    mtype VARCHAR(50) NOT NULL,
+    value DOUBLE PRECISION,
+    delta BIGINT
+);
@@ -0,0 +1,10 @@
+-- sample history, partitions are created ahead and dropped by the server
+CREATE TABLE metric_samples (
+    id VARCHAR(255) NOT NULL,
+    mtype VARCHAR(50) NOT NULL,
+    ts TIMESTAMPTZ NOT NULL,
+    value DOUBLE PRECISION,
+    delta BIGINT
+) PARTITION BY RANGE (ts);
+
+CREATE INDEX metric_samples_series_ts ON metric_samples (id, mtype, ts);
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS metrics_notify_truncate ON metrics;
+DROP TRIGGER IF EXISTS metrics_notify_rows ON metrics;
+DROP FUNCTION IF EXISTS metrics_notify();
@@ -0,0 +1,25 @@
+-- tells listening replicas which series changed, so they can drop cached values.
+-- NOTIFY payloads repeated within a transaction are delivered once
+CREATE OR REPLACE FUNCTION metrics_notify() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'TRUNCATE' THEN
+        PERFORM pg_notify('metrics_changed', '*');
+        RETURN NULL;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM pg_notify('metrics_changed', OLD.mtype || '/' || OLD.id);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('metrics_changed', NEW.mtype || '/' || NEW.id);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER metrics_notify_rows
+    AFTER INSERT OR UPDATE OR DELETE ON metrics
+    FOR EACH ROW EXECUTE FUNCTION metrics_notify();
+
+CREATE TRIGGER metrics_notify_truncate
+    AFTER TRUNCATE ON metrics
+    FOR EACH STATEMENT EXECUTE FUNCTION metrics_notify();
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS metrics_notify_delete ON metrics;
+DROP TRIGGER IF EXISTS metrics_notify_update ON metrics;
+DROP TRIGGER IF EXISTS metrics_notify_insert ON metrics;
+DROP FUNCTION IF EXISTS metrics_notify_statement();
+
+CREATE TRIGGER metrics_notify_rows
+    AFTER INSERT OR UPDATE OR DELETE ON metrics
+    FOR EACH ROW EXECUTE FUNCTION metrics_notify();
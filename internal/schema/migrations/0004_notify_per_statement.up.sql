@@ -0,0 +1,48 @@
+-- one notification per statement instead of one per row, a batch upsert of
+-- thousands of series no longer queues thousands of notifications.
+-- the payload is the changed "type/id" keys separated by newlines, or "*"
+-- when they do not fit into a notification
+DROP TRIGGER IF EXISTS metrics_notify_rows ON metrics;
+
+CREATE OR REPLACE FUNCTION metrics_notify_statement() RETURNS trigger AS $$
+DECLARE
+    payload text;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        SELECT string_agg(k, E'\n') INTO payload
+            FROM (SELECT DISTINCT mtype || '/' || id AS k FROM new_rows) keys;
+    ELSIF TG_OP = 'DELETE' THEN
+        SELECT string_agg(k, E'\n') INTO payload
+            FROM (SELECT DISTINCT mtype || '/' || id AS k FROM old_rows) keys;
+    ELSE
+        SELECT string_agg(k, E'\n') INTO payload
+            FROM (SELECT mtype || '/' || id AS k FROM old_rows
+                  UNION SELECT mtype || '/' || id FROM new_rows) keys;
+    END IF;
+    -- statement changed no rows
+    IF payload IS NULL THEN
+        RETURN NULL;
+    END IF;
+    -- notification payloads are limited to 8000 bytes
+    IF octet_length(payload) > 7900 THEN
+        payload := '*';
+    END IF;
+    PERFORM pg_notify('metrics_changed', payload);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER metrics_notify_insert
+    AFTER INSERT ON metrics
+    REFERENCING NEW TABLE AS new_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION metrics_notify_statement();
+
+CREATE TRIGGER metrics_notify_update
+    AFTER UPDATE ON metrics
+    REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION metrics_notify_statement();
+
+CREATE TRIGGER metrics_notify_delete
+    AFTER DELETE ON metrics
+    REFERENCING OLD TABLE AS old_rows
+    FOR EACH STATEMENT EXECUTE FUNCTION metrics_notify_statement();
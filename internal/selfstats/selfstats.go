@@ -0,0 +1,170 @@
+package selfstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"go.uber.org/zap"
+)
+
+// Prefix is reserved for the server's own series
+const Prefix = "_server."
+
+// latency histogram bucket bounds
+var buckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Default registry, used where no other one is given
+var Default = New()
+
+type ctxKey struct{}
+
+// WithContext returns ctx carrying r, stats recorded under it go to r
+func WithContext(ctx context.Context, r *Registry) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// FromContext returns the registry put into ctx by WithContext, Default if there is none
+func FromContext(ctx context.Context) *Registry {
+	if r, ok := ctx.Value(ctxKey{}).(*Registry); ok {
+		return r
+	}
+	return Default
+}
+
+// Or returns r, Default if it is nil
+func Or(r *Registry) *Registry {
+	if r == nil {
+		return Default
+	}
+	return r
+}
+
+// Registry accumulates internal stats between flushes to storage
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]int64   // deltas since the last flush
+	gauges   map[string]float64 // absolute values
+}
+
+func New() *Registry {
+	return &Registry{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+// Reserved reports whether id belongs to the server's own series
+func Reserved(id string) bool {
+	return strings.HasPrefix(id, Prefix)
+}
+
+// Name joins parts into a dotted series name, anything that is not
+// a letter or digit works as a separator
+func Name(parts ...string) string {
+	var fields []string
+	for _, p := range parts {
+		fields = append(fields, strings.FieldsFunc(p, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		})...)
+	}
+	return strings.Join(fields, ".")
+}
+
+func (r *Registry) Inc(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *Registry) Set(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+// Observe records d into a cumulative latency histogram:
+// <name>.le_<bound> and <name>.count counters plus <name>.sum_seconds gauge
+func (r *Registry) Observe(name string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, b := range buckets {
+		if d <= b {
+			r.counters[fmt.Sprintf("%s.le_%s", name, b)]++
+		}
+	}
+	r.counters[name+".le_inf"]++
+	r.counters[name+".count"]++
+	r.gauges[name+".sum_seconds"] += d.Seconds()
+}
+
+// Snapshot returns collected stats as metrics and resets counter deltas
+func (r *Registry) Snapshot() collector.Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics := make(collector.Metrics, 0, len(r.counters)+len(r.gauges))
+	for name, delta := range r.counters {
+		if delta == 0 {
+			continue
+		}
+		d := delta
+		metrics = append(metrics, collector.Metric{ID: Prefix + name, MType: "counter", Delta: &d})
+		r.counters[name] = 0
+	}
+	for name, value := range r.gauges {
+		v := value
+		metrics = append(metrics, collector.Metric{ID: Prefix + name, MType: "gauge", Value: &v})
+	}
+	return metrics
+}
+
+type batchUpdater interface {
+	UpdateBatch(ctx context.Context, metrics collector.Metrics) error
+}
+
+// Flush writes collected stats through the regular storage path
+func (r *Registry) Flush(ctx context.Context, db batchUpdater) error {
+	metrics := r.Snapshot()
+	if len(metrics) == 0 {
+		return nil
+	}
+	if err := db.UpdateBatch(ctx, metrics); err != nil {
+		// keep counter deltas for the next flush
+		for _, m := range metrics {
+			if m.Delta != nil {
+				r.Inc(strings.TrimPrefix(m.ID, Prefix), *m.Delta)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// FlushWithInterval flushes stats until ctx is done
+func (r *Registry) FlushWithInterval(ctx context.Context, db batchUpdater, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.Flush(ctx, db); err != nil {
+			logger.FromContext(ctx).Error("error while flushing server stats", zap.Error(err))
+		}
+	}
+}
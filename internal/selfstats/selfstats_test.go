@@ -0,0 +1,63 @@
+package selfstats
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeStorage struct {
+	err     error
+	batches []collector.Metrics
+}
+
+func (f *fakeStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.batches = append(f.batches, metrics)
+	return nil
+}
+
+func byID(metrics collector.Metrics) map[string]collector.Metric {
+	m := make(map[string]collector.Metric)
+	for _, metric := range metrics {
+		m[metric.ID] = metric
+	}
+	return m
+}
+
+func TestRegistry(t *testing.T) {
+	r := New()
+	r.Inc("hmac.failures", 2)
+	r.Set("http.batch.last_size", 30)
+	r.Observe("http.POST.updates.latency", 3*time.Millisecond)
+
+	db := &fakeStorage{err: errors.New("down")}
+	assert.Error(t, r.Flush(context.Background(), db))
+
+	// deltas survive a failed flush
+	db.err = nil
+	assert.NoError(t, r.Flush(context.Background(), db))
+	got := byID(db.batches[0])
+	assert.Equal(t, int64(2), *got["_server.hmac.failures"].Delta)
+	assert.Equal(t, 30.0, *got["_server.http.batch.last_size"].Value)
+	assert.Equal(t, int64(1), *got["_server.http.POST.updates.latency.le_5ms"].Delta)
+	assert.NotContains(t, got, "_server.http.POST.updates.latency.le_1ms")
+
+	// only gauges are left after counters were flushed
+	assert.NoError(t, r.Flush(context.Background(), db))
+	for _, m := range db.batches[1] {
+		assert.Equal(t, "gauge", m.MType)
+	}
+}
+
+func TestName(t *testing.T) {
+	assert.Equal(t, "http.POST.update.metricType.metricName", Name("http", "POST", "/update/:metricType/:metricName/"))
+	assert.True(t, Reserved("_server.hmac.failures"))
+	assert.False(t, Reserved("Alloc"))
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNode struct {
+	url string
+	srv *Server
+}
+
+// starts n in-process nodes that know about each other
+func newTestCluster(t *testing.T, n int, key string) []testNode {
+	listeners := make([]*httptest.Server, n)
+	var urls []string
+	for i := range listeners {
+		listeners[i] = httptest.NewUnstartedServer(nil)
+		urls = append(urls, "http://"+listeners[i].Listener.Addr().String())
+	}
+	nodes := make([]testNode, n)
+	for i, ts := range listeners {
+		cfg := config.DefaultServer()
+		cfg.FileStoragePath = filepath.Join(t.TempDir(), "metrics.json")
+		cfg.Restore = false
+		cfg.Key = key
+		cfg.Cluster.Self = urls[i]
+		cfg.Cluster.Nodes = urls
+
+		srv, err := NewServer(WithConfig(&cfg))
+		require.NoError(t, err)
+		t.Cleanup(func() { srv.Close() })
+		ts.Config.Handler = srv.Handler()
+		ts.Start()
+		t.Cleanup(ts.Close)
+		nodes[i] = testNode{url: urls[i], srv: srv}
+	}
+	return nodes
+}
+
+// series stored by node itself
+func localIDs(t *testing.T, node testNode) []string {
+	metrics, err := node.srv.mem.Export(context.Background())
+	require.NoError(t, err)
+	var ids []string
+	for _, m := range metrics {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestCluster(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	nodes := newTestCluster(t, 3, "secret")
+
+	var batch collector.Metrics
+	for i := 0; i < 60; i++ {
+		d := int64(i)
+		batch = append(batch, collector.Metric{ID: fmt.Sprintf("requests_%d", i), MType: "counter", Delta: &d})
+	}
+	body, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, err := http.Post(nodes[0].url+"/updates/", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// every series lives on its owner only
+	total := 0
+	for _, node := range nodes {
+		ids := localIDs(t, node)
+		total += len(ids)
+		assert.NotEmpty(t, ids, "%s owns some series", node.url)
+		for _, id := range ids {
+			assert.Equal(t, node.url, node.srv.cluster.Owner(id))
+		}
+	}
+	assert.Equal(t, 60, total)
+
+	// any node answers for any series
+	for _, node := range nodes {
+		status, value := get(t, node.url+"/value/counter/requests_7/")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "7", value)
+	}
+	resp, err = http.Post(nodes[2].url+"/update/counter/requests_7/3", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	status, value := get(t, nodes[1].url+"/value/counter/requests_7/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "10", value)
+	status, _ = get(t, nodes[1].url+"/value/counter/missing/")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// node-to-node endpoints need a signature while a key is set
+	resp, err = http.Post(nodes[0].url+"/cluster/updates/", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestClusterRebalance(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	nodes := newTestCluster(t, 3, "")
+
+	for i := 0; i < 60; i++ {
+		resp, err := http.Post(fmt.Sprintf("%s/update/counter/requests_%d/%d", nodes[0].url, i, i), "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// the last node leaves, the others take its series
+	leaving := nodes[2]
+	stay := []string{nodes[0].url, nodes[1].url}
+	for _, node := range nodes {
+		require.True(t, node.srv.cluster.SetMembers(stay))
+	}
+	moved, err := leaving.srv.cluster.Rebalance(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, moved)
+	assert.Empty(t, localIDs(t, leaving))
+
+	for i := 0; i < 60; i++ {
+		status, body := get(t, fmt.Sprintf("%s/value/counter/requests_%d/", nodes[i%2].url, i))
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, fmt.Sprint(i), body, "counters are moved, not added twice")
+	}
+
+	// and joins again
+	for _, node := range nodes {
+		require.True(t, node.srv.cluster.SetMembers([]string{nodes[0].url, nodes[1].url, nodes[2].url}))
+	}
+	for _, node := range nodes[:2] {
+		_, err := node.srv.cluster.Rebalance(ctx)
+		require.NoError(t, err)
+	}
+	assert.NotEmpty(t, localIDs(t, leaving))
+	for i := 0; i < 60; i++ {
+		status, body := get(t, fmt.Sprintf("%s/value/counter/requests_%d/", nodes[2].url, i))
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, fmt.Sprint(i), body)
+	}
+
+	status, body := get(t, nodes[0].url+"/cluster/members")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"member":true`)
+}
@@ -0,0 +1,527 @@
+// Package server wires config, storage and handlers into a metrics server.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/cluster"
+	"github.com/paranoiachains/metrics/internal/config"
+	"github.com/paranoiachains/metrics/internal/handlers"
+	"github.com/paranoiachains/metrics/internal/health"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/middleware"
+	"github.com/paranoiachains/metrics/internal/notifier"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"github.com/paranoiachains/metrics/internal/storage"
+	"github.com/paranoiachains/metrics/internal/tracing"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+)
+
+// time given to in-flight requests after a shutdown signal
+const shutdownTimeout = 10 * time.Second
+
+// how often the server's own stats are written to storage
+const selfStatsInterval = 10 * time.Second
+
+// how often storage housekeeping runs, e.g. creating sample partitions ahead
+const maintenanceInterval = time.Hour
+
+// Server owns its config, logger, storage and router
+type Server struct {
+	cfgs        *config.Store[config.Server]
+	log         *zap.Logger
+	stats       *selfstats.Registry // the server's own series, flushed into db
+	db          storage.Database
+	mem         *storage.MemStorage // set when metrics are persisted to file
+	events      *storage.Hub
+	checker     *health.Checker
+	persistence *storage.PersistenceStatus
+	tracer      *sdktrace.TracerProvider // set when storage spans are exported
+	cluster     *cluster.Cluster         // set in cluster mode, db routes series through it
+	notifier    *notifier.Dispatcher     // set when webhooks are configured
+	router      *gin.Engine
+}
+
+type Option func(*Server)
+
+// WithConfig uses a fixed config, it is not reloaded
+func WithConfig(cfg *config.Server) Option {
+	return func(s *Server) {
+		s.cfgs = config.NewServerStore(cfg, nil)
+	}
+}
+
+// WithConfigStore uses config that may be reloaded at runtime
+func WithConfigStore(cfgs *config.Store[config.Server]) Option {
+	return func(s *Server) {
+		s.cfgs = cfgs
+	}
+}
+
+// WithLogger is used by the server, its handlers and storage
+func WithLogger(log *zap.Logger) Option {
+	return func(s *Server) {
+		s.log = log
+	}
+}
+
+// WithStats records the server's own stats into stats instead of a registry of its own
+func WithStats(stats *selfstats.Registry) Option {
+	return func(s *Server) {
+		s.stats = stats
+	}
+}
+
+// WithStorage replaces the storage chosen by config
+func WithStorage(db storage.Database) Option {
+	return func(s *Server) {
+		s.db = db
+	}
+}
+
+// WithEvents sets the hub storage publishes to, must match the storage given with WithStorage
+func WithEvents(events *storage.Hub) Option {
+	return func(s *Server) {
+		s.events = events
+	}
+}
+
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		log:         zap.NewNop(),
+		stats:       selfstats.New(),
+		checker:     health.NewChecker(),
+		persistence: &storage.PersistenceStatus{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.cfgs == nil {
+		def := config.DefaultServer()
+		s.cfgs = config.NewServerStore(&def, nil)
+	}
+	if s.events == nil {
+		s.events = storage.NewHub(0)
+	}
+	cfg := s.cfgs.Get()
+
+	if s.db == nil {
+		layers, err := s.storageLayers(cfg)
+		if err != nil {
+			return nil, err
+		}
+		db, err := storage.DetermineStorage(cfg.StorageURL(), storage.Options{
+			Driver:     cfg.DatabaseDriver,
+			Pool:       poolConfig(cfg.DB),
+			History:    partitioning(cfg.History),
+			Cache:      cacheOptions(cfg.Cache),
+			Events:     s.events,
+			Decorators: layers,
+			Log:        s.log,
+			Stats:      s.stats,
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.db = db
+	}
+	if mem, ok := storage.Unwrap(s.db).(*storage.MemStorage); ok {
+		s.mem = mem
+		s.mem.SnapshotKeep = cfg.SnapshotKeep
+		s.mem.SnapshotFormat = cfg.SnapshotFormat
+		if _, err := storage.CodecFor(cfg.SnapshotFormat, cfg.FileStoragePath); err != nil {
+			return nil, err
+		}
+		if err := s.prepareFile(cfg); err != nil {
+			s.mem.Close()
+			return nil, err
+		}
+	}
+
+	if cfg.Cluster.Enabled() {
+		if err := s.joinCluster(cfg); err != nil {
+			if s.mem != nil {
+				s.mem.Close()
+			}
+			return nil, err
+		}
+	}
+
+	if cfg.Webhooks.Enabled() {
+		s.notifier = notifier.NewDispatcher(notifierConfig(cfg.Webhooks))
+	}
+
+	s.checker.Register("storage", func(ctx context.Context) error {
+		return storage.Ping(ctx, s.db)
+	})
+	if s.mem != nil {
+		s.checker.Register("persistence", s.persistence.Check)
+	}
+
+	s.router = s.routes()
+	return s, nil
+}
+
+// restores or clears file storage, opens the wal
+func (s *Server) prepareFile(cfg *config.Server) error {
+	if dir := filepath.Dir(cfg.FileStoragePath); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	walPath := cfg.FileStoragePath + ".wal"
+	if !cfg.Restore {
+		s.mem.Clear()
+		if err := os.Remove(walPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.WriteFile(cfg.FileStoragePath, nil, 0644); err != nil {
+			return err
+		}
+	}
+	if cfg.WAL {
+		sync := time.Duration(cfg.WALSyncMillis) * time.Millisecond
+		if err := s.mem.OpenWAL(walPath, sync); err != nil {
+			return err
+		}
+	}
+	if !cfg.Restore {
+		return nil
+	}
+	if err := s.mem.Restore(cfg.FileStoragePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.log.Error("error while restoring storage", zap.Error(err))
+	}
+	return nil
+}
+
+func (s *Server) routes() *gin.Engine {
+	key := func() string { return s.cfgs.Get().Key }
+
+	r := gin.New()
+	r.Use(gin.Recovery(), middleware.Instrument(s.stats), middleware.LoggerMiddleware(s.log), middleware.GzipMiddleware(), middleware.Hash(key))
+
+	// HTML response
+	r.GET("/", handlers.HTMLReturnAll)
+
+	// Ping Database
+	r.GET("/ping", handlers.Ping(s.db))
+
+	// probes
+	r.GET("/healthz", handlers.Healthz)
+	r.GET("/readyz", handlers.Readyz(s.checker))
+	r.GET("/health", handlers.HealthDetails(s.checker))
+
+	// admin
+	admin := r.Group("/admin", middleware.AdminAuth(func() string { return s.cfgs.Get().AdminToken }))
+	admin.GET("/reload", handlers.ReloadStatus(s.cfgs))
+	admin.POST("/reload", handlers.Reload(s.cfgs))
+	admin.POST("/snapshot", handlers.Snapshot(s.db, func() string { return s.cfgs.Get().BackupDir }))
+	admin.GET("/backup", handlers.Backup(s.db))
+	admin.POST("/restore", handlers.Restore(s.db))
+	admin.GET("/db/stats", handlers.PoolStats(s.db))
+
+	// JSON requests
+	r.POST("/update/", handlers.JSONUpdate(s.db))
+	r.POST("/updates/", handlers.JSONBatch(s.db))
+	r.POST("/value/", handlers.JSONValue(s.db))
+
+	// persistent agent connections
+	r.GET("/ws/updates", handlers.WSUpdates(s.db, key))
+
+	// live updates
+	r.GET("/api/stream", handlers.Stream(s.events))
+
+	// other cluster nodes, they act on this node's series only
+	if s.cluster != nil {
+		local := s.cluster.Unwrap()
+		nodes := r.Group("/cluster")
+		nodes.POST("/updates/", middleware.RequireSignature(key), handlers.ClusterUpdates(local))
+		nodes.POST("/handoff/", middleware.RequireSignature(key), handlers.ClusterHandoff(local))
+		nodes.GET("/value/:metricType/:metricName/", handlers.ClusterValue(local))
+		nodes.GET("/members", handlers.ClusterMembers(s.cluster))
+	}
+
+	// casual url requests
+	r.POST("/update/:metricType/:metricName/:metricValue", handlers.URLUpdate(s.db))
+	r.GET("/value/:metricType/:metricName/", handlers.URLValue(s.db))
+	r.GET("/history/:metricType/:metricName/", handlers.History(s.db))
+
+	return r
+}
+
+// Handler returns the router, e.g. for httptest
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+func (s *Server) Storage() storage.Database {
+	return s.db
+}
+
+// Run serves on the configured address until ctx is done, then shuts down gracefully
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfgs.Get().Address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve is Run on an existing listener
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	ctx, stop := context.WithCancel(s.context(ctx))
+	defer stop()
+
+	go s.stats.FlushWithInterval(ctx, s.db, selfStatsInterval)
+
+	// JSON file storage
+	var writer sync.WaitGroup
+	if s.mem != nil {
+		cfg := s.cfgs.Get()
+		writer.Add(1)
+		go func() {
+			defer writer.Done()
+			storage.WriteWithInterval(ctx, s.mem, cfg.FileStoragePath, func() int {
+				return s.cfgs.Get().StoreInterval
+			}, s.persistence)
+		}()
+	}
+
+	// sample partitions and retention
+	if m, ok := storage.Unwrap(s.db).(storage.Maintainer); ok {
+		writer.Add(1)
+		go func() {
+			defer writer.Done()
+			m.Maintain(ctx, maintenanceInterval)
+		}()
+	}
+
+	// membership changes move series between nodes
+	if s.cluster != nil {
+		refresh := time.Duration(s.cfgs.Get().Cluster.RefreshSec) * time.Second
+		writer.Add(1)
+		go func() {
+			defer writer.Done()
+			s.cluster.Run(ctx, s.members, refresh)
+		}()
+	}
+
+	// the read cache is only used while it hears about changes
+	if c, ok := storage.As[*storage.CachedStorage](s.db); ok {
+		writer.Add(1)
+		go func() {
+			defer writer.Done()
+			c.Listen(ctx)
+		}()
+	}
+
+	// request contexts are cancelled on shutdown so that streams end
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Handler:     s.router,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	srv.RegisterOnShutdown(cancelRequests)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	s.log.Info("shutting down")
+	s.checker.SetShuttingDown()
+
+	// stop accepting requests and drain in-flight ones
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		s.log.Error("error while shutting down server", zap.Error(err))
+	}
+
+	writer.Wait()
+	s.Close()
+	s.log.Info("server stopped")
+
+	select {
+	case err := <-serveErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// context carries the server's logger and stats to storage and background work
+func (s *Server) context(ctx context.Context) context.Context {
+	return selfstats.WithContext(logger.WithContext(ctx, s.log), s.stats)
+}
+
+// Stats is the registry the server's own series are recorded into
+func (s *Server) Stats() *selfstats.Registry {
+	return s.stats
+}
+
+// Notifier delivers alert state changes to webhooks, nil when none are configured
+func (s *Server) Notifier() *notifier.Dispatcher {
+	return s.notifier
+}
+
+// Close flushes in-memory data and closes storage
+func (s *Server) Close() error {
+	var errs []error
+	if s.notifier != nil {
+		// sends what is still grouped
+		s.notifier.Close()
+	}
+	if err := s.stats.Flush(s.context(context.Background()), s.db); err != nil {
+		errs = append(errs, fmt.Errorf("flushing server stats: %w", err))
+	}
+	if s.mem != nil {
+		if err := storage.Flush(s.mem, s.cfgs.Get().FileStoragePath); err != nil {
+			errs = append(errs, fmt.Errorf("writing storage: %w", err))
+		}
+	}
+	if closer, ok := storage.Unwrap(s.db).(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing db: %w", err))
+		}
+	}
+	if s.tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.tracer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("flushing spans: %w", err))
+		}
+	}
+	err := errors.Join(errs...)
+	if err != nil {
+		s.log.Error("error while closing server", zap.Error(err))
+	}
+	return err
+}
+
+// joinCluster routes series to their owners, reads and writes of other nodes' series go over http
+func (s *Server) joinCluster(cfg *config.Server) error {
+	s.cluster = cluster.New(s.db, cluster.Config{
+		Self:     cfg.Cluster.Self,
+		Replicas: cfg.Cluster.Replicas,
+		Key:      func() string { return s.cfgs.Get().Key },
+	})
+	nodes, err := s.members()
+	if err != nil {
+		return fmt.Errorf("reading cluster members: %w", err)
+	}
+	s.cluster.SetMembers(nodes)
+	s.log.Info("joined cluster", zap.String("self", s.cluster.Self()), zap.Strings("nodes", s.cluster.Ring().Nodes()))
+	s.db = s.cluster
+	return nil
+}
+
+// members are the configured nodes plus the nodes file, both may change while running
+func (s *Server) members() ([]string, error) {
+	cfg := s.cfgs.Get().Cluster
+	nodes := slices.Clone(cfg.Nodes)
+	if cfg.NodesFile != "" {
+		fromFile, err := cluster.ReadMembers(cfg.NodesFile)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, fromFile...)
+	}
+	return nodes, nil
+}
+
+// storageLayers wraps storage as configured, outermost first
+func (s *Server) storageLayers(cfg *config.Server) ([]storage.Decorator, error) {
+	var layers []storage.Decorator
+	if cfg.StorageLayers.Trace {
+		tp, err := tracing.Setup(context.Background(), "metrics-server")
+		if err != nil {
+			return nil, fmt.Errorf("setting up tracing: %w", err)
+		}
+		s.tracer = tp
+		layers = append(layers, storage.WithTracing(tp))
+	}
+	if cfg.StorageLayers.Stats {
+		scheme, _ := storage.ParseStorage(cfg.StorageURL())
+		layers = append(layers, storage.WithStats(scheme))
+	}
+	if cfg.StorageLayers.Log {
+		layers = append(layers, storage.WithLogging(s.log))
+	}
+	if cfg.StorageLayers.Chaos() {
+		chaos := storage.ChaosConfig{
+			Latency:     time.Duration(cfg.StorageLayers.ChaosLatencyMs) * time.Millisecond,
+			LatencyRate: cfg.StorageLayers.ChaosLatencyRate,
+			ErrorRate:   cfg.StorageLayers.ChaosErrorRate,
+		}
+		s.log.Warn("injecting storage faults", zap.Duration("latency", chaos.Latency), zap.Float64("latency_rate", chaos.LatencyRate), zap.Float64("error_rate", chaos.ErrorRate))
+		layers = append(layers, storage.WithChaos(chaos))
+	}
+	return layers, nil
+}
+
+func poolConfig(cfg config.DB) storage.PoolConfig {
+	return storage.PoolConfig{
+		MaxOpenConns:     cfg.MaxOpenConns,
+		MaxIdleConns:     cfg.MaxIdleConns,
+		ConnMaxLifetime:  time.Duration(cfg.ConnMaxLifetimeSec) * time.Second,
+		ConnMaxIdleTime:  time.Duration(cfg.ConnMaxIdleSec) * time.Second,
+		StatementTimeout: time.Duration(cfg.StatementTimeoutMs) * time.Millisecond,
+		Retry: storage.RetryPolicy{
+			Attempts: cfg.RetryAttempts,
+			Base:     time.Duration(cfg.RetryBaseMs) * time.Millisecond,
+			Max:      time.Duration(cfg.RetryMaxMs) * time.Millisecond,
+		},
+		BreakerThreshold: cfg.BreakerThreshold,
+		BreakerCooldown:  time.Duration(cfg.BreakerCooldownSec) * time.Second,
+	}
+}
+
+// nil if history is disabled
+func partitioning(cfg config.History) *storage.Partitioning {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &storage.Partitioning{
+		Period:    cfg.Partition,
+		Ahead:     cfg.Ahead,
+		Retention: time.Duration(cfg.RetentionDays) * 24 * time.Hour,
+	}
+}
+
+func notifierConfig(cfg config.Webhooks) notifier.Config {
+	return notifier.Config{
+		URLs:        cfg.URLs,
+		Key:         cfg.Key,
+		GroupWait:   time.Duration(cfg.GroupWaitMs) * time.Millisecond,
+		MaxAttempts: cfg.MaxAttempts,
+		Backoff:     time.Duration(cfg.BackoffMs) * time.Millisecond,
+		Timeout:     time.Duration(cfg.TimeoutMs) * time.Millisecond,
+	}
+}
+
+func cacheOptions(cfg config.Cache) *storage.CacheOptions {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &storage.CacheOptions{
+		Size: cfg.Size,
+		TTL:  time.Duration(cfg.TTLMs) * time.Millisecond,
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/config"
+	"github.com/paranoiachains/metrics/internal/notifier"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, opts ...func(*config.Server)) *httptest.Server {
+	cfg := config.DefaultServer()
+	cfg.FileStoragePath = filepath.Join(t.TempDir(), "metrics.json")
+	cfg.Restore = false
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	srv, err := NewServer(WithConfig(&cfg))
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestIndependentServers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	first := newTestServer(t)
+	second := newTestServer(t)
+
+	resp, err := http.Post(first.URL+"/update/counter/requests/5", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	status, body := get(t, first.URL+"/value/counter/requests/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "5", body)
+
+	// storage is not shared
+	status, _ = get(t, second.URL+"/value/counter/requests/")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// file writer only runs in Run
+	status, _ = get(t, first.URL+"/healthz")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = get(t, first.URL+"/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	// memory storage keeps no samples
+	status, _ = get(t, first.URL+"/history/counter/requests/")
+	assert.Equal(t, http.StatusNotImplemented, status)
+	status, _ = get(t, first.URL+"/history/counter/requests/?from=yesterday")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestIndependentServerStats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newServer := func(opts ...Option) *Server {
+		cfg := config.DefaultServer()
+		cfg.FileStoragePath = filepath.Join(t.TempDir(), "metrics.json")
+		cfg.Restore = false
+		cfg.StorageLayers.Stats = true
+		srv, err := NewServer(append(opts, WithConfig(&cfg))...)
+		require.NoError(t, err)
+		t.Cleanup(func() { srv.Close() })
+		return srv
+	}
+	shared := selfstats.New()
+	first := newServer(WithStats(shared))
+	second := newServer()
+	require.Same(t, shared, first.Stats())
+
+	req := httptest.NewRequest(http.MethodPost, "/update/counter/requests/5", nil)
+	first.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	ids := func(srv *Server) []string {
+		var ids []string
+		for _, m := range srv.Stats().Snapshot() {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+	got := ids(first)
+	assert.Contains(t, got, "_server.http.POST.update.metricType.metricName.metricValue.requests.200")
+	assert.Contains(t, got, "_server.storage.memory.update.latency.count")
+	assert.Empty(t, ids(second))
+}
+
+func TestStorageChaos(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ts := newTestServer(t, func(cfg *config.Server) {
+		cfg.StorageLayers.Log = true
+		cfg.StorageLayers.ChaosErrorRate = 1
+	})
+
+	resp, err := http.Post(ts.URL+"/update/counter/requests/5", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	status, _ := get(t, ts.URL+"/value/counter/requests/")
+	assert.Equal(t, http.StatusNotFound, status, "every storage call fails")
+}
+
+func adminRequest(t *testing.T, method, url, token string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+func TestBackupRestore(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const token = "secret"
+	withToken := func(cfg *config.Server) {
+		cfg.AdminToken = token
+		cfg.BackupDir = filepath.Join(t.TempDir(), "backups")
+	}
+	first := newTestServer(t, withToken)
+	second := newTestServer(t, withToken)
+
+	// disabled without a token, rejected with a wrong one
+	status, _ := adminRequest(t, http.MethodGet, newTestServer(t).URL+"/admin/backup", "", nil)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = adminRequest(t, http.MethodGet, first.URL+"/admin/backup", "wrong", nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	for _, path := range []string{"/update/counter/requests/5", "/update/gauge/load/0.5"} {
+		resp, err := http.Post(first.URL+path, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	resp, err := http.Post(second.URL+"/update/gauge/stale/1", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	status, _ = adminRequest(t, http.MethodPost, first.URL+"/admin/snapshot?format=gob", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, backup := adminRequest(t, http.MethodGet, first.URL+"/admin/backup?format=protobuf", token, nil)
+	require.Equal(t, http.StatusOK, status)
+
+	status, _ = adminRequest(t, http.MethodPost, second.URL+"/admin/restore?mode=replace", token, backup[:len(backup)-1])
+	assert.Equal(t, http.StatusBadRequest, status, "truncated backup")
+	status, _ = adminRequest(t, http.MethodPost, second.URL+"/admin/restore?mode=replace", token, backup)
+	require.Equal(t, http.StatusOK, status)
+
+	_, body := get(t, second.URL+"/value/counter/requests/")
+	assert.Equal(t, "5", body)
+	_, body = get(t, second.URL+"/value/gauge/load/")
+	assert.Equal(t, "0.5", body)
+	status, _ = get(t, second.URL+"/value/gauge/stale/")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// memory storage has no connection pool
+	status, _ = adminRequest(t, http.MethodGet, first.URL+"/admin/db/stats", token, nil)
+	assert.Equal(t, http.StatusNotImplemented, status)
+}
+
+func TestAgentTelemetryPerAgent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ts := newTestServer(t)
+
+	// two agents reporting to one memory storage
+	for _, id := range []string{"a", "b"} {
+		cfg := config.DefaultAgent()
+		cfg.Address = strings.TrimPrefix(ts.URL, "http://")
+		cfg.ID = id
+		require.NoError(t, collector.Send(&cfg))
+	}
+	for _, id := range []string{"a", "b"} {
+		status, body := get(t, ts.URL+"/value/counter/agent."+id+".send.attempts/")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "1", body, "attempts of agent %s are its own", id)
+		status, _ = get(t, ts.URL+"/value/gauge/agent."+id+".pending_polls/")
+		assert.Equal(t, http.StatusOK, status)
+	}
+	status, _ := get(t, ts.URL+"/value/counter/agent.send.attempts/")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestServerWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var payloads []notifier.Payload
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p notifier.Payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		mu.Lock()
+		payloads = append(payloads, p)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	cfg := config.DefaultServer()
+	cfg.FileStoragePath = filepath.Join(t.TempDir(), "metrics.json")
+	cfg.Restore = false
+	srv, err := NewServer(WithConfig(&cfg))
+	require.NoError(t, err)
+	assert.Nil(t, srv.Notifier(), "no receivers configured")
+	require.NoError(t, srv.Close())
+
+	cfg.Webhooks.URLs = []string{receiver.URL}
+	cfg.Webhooks.GroupWaitMs = int(time.Hour / time.Millisecond)
+	srv, err = NewServer(WithConfig(&cfg))
+	require.NoError(t, err)
+	require.NotNil(t, srv.Notifier())
+	srv.Notifier().Notify(notifier.Notification{Rule: "gc", State: notifier.StateFiring, Metric: "NumGC"})
+
+	// shutdown does not wait out the group, what is queued is sent
+	require.NoError(t, srv.Close())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, payloads, 1)
+	assert.Equal(t, "gc", payloads[0].Rule)
+}
+
+func TestServerStorageDirError(t *testing.T) {
+	// a file where the storage directory should be
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	require.NoError(t, os.WriteFile(blocker, nil, 0644))
+
+	cfg := config.DefaultServer()
+	cfg.FileStoragePath = filepath.Join(blocker, "metrics.json")
+	cfg.Restore = false
+	_, err := NewServer(WithConfig(&cfg))
+	assert.Error(t, err)
+}
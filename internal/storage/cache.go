@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"hash/fnv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/jackc/pgx/v5"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"go.uber.org/zap"
+)
+
+// postgres channel the metrics_notify triggers write changed "type/id" keys to,
+// one per line. "*" means everything
+const changesChannel = "metrics_changed"
+
+// invalidations are tracked per bucket of keys, so a write to one series does not
+// stop reads of every other series from being cached
+const cacheBuckets = 256
+
+// CacheOptions bounds the read cache
+type CacheOptions struct {
+	Size int
+	TTL  time.Duration
+}
+
+// CachedStorage serves Return from an LRU in front of postgres, writes go through.
+// values are only cached while Listen receives change notifications, so a write by
+// another replica drops the entry everywhere. without a listener every read goes to the database
+type CachedStorage struct {
+	Database
+	dsn     string
+	entries *expirable.LRU[string, collector.Metric]
+	live    atomic.Bool
+	// a read started before an invalidation of its bucket or a purge is not cached
+	gens  [cacheBuckets]atomic.Uint64
+	epoch atomic.Uint64
+}
+
+func NewCachedStorage(db Database, dsn string, opts CacheOptions) *CachedStorage {
+	return &CachedStorage{
+		Database: db,
+		dsn:      dsn,
+		entries:  expirable.NewLRU[string, collector.Metric](opts.Size, nil, opts.TTL),
+	}
+}
+
+func (c *CachedStorage) Unwrap() Database {
+	return c.Database
+}
+
+// callers get their own value pointers
+func cloneMetric(m collector.Metric) *collector.Metric {
+	if m.Value != nil {
+		v := *m.Value
+		m.Value = &v
+	}
+	if m.Delta != nil {
+		d := *m.Delta
+		m.Delta = &d
+	}
+	return &m
+}
+
+func cacheKey(mtype, id string) string {
+	return mtype + "/" + id
+}
+
+func (c *CachedStorage) bucket(key string) *atomic.Uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.gens[h.Sum32()%cacheBuckets]
+}
+
+func (c *CachedStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	if !c.live.Load() {
+		return c.Database.Return(ctx, mtype, id)
+	}
+	key := cacheKey(mtype, id)
+	if metric, ok := c.entries.Get(key); ok {
+		selfstats.FromContext(ctx).Inc("storage.cache.hits", 1)
+		return cloneMetric(metric), nil
+	}
+	selfstats.FromContext(ctx).Inc("storage.cache.misses", 1)
+
+	bucket := c.bucket(key)
+	gen, epoch := bucket.Load(), c.epoch.Load()
+	metric, err := c.Database.Return(ctx, mtype, id)
+	if err != nil {
+		return nil, err
+	}
+	if bucket.Load() == gen && c.epoch.Load() == epoch {
+		c.entries.Add(key, *cloneMetric(*metric))
+	}
+	return metric, nil
+}
+
+func (c *CachedStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	err := c.Database.Update(ctx, mtype, id, value)
+	// dropped even on error, the write may have happened
+	c.Invalidate(cacheKey(mtype, id))
+	return err
+}
+
+func (c *CachedStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	err := c.Database.UpdateBatch(ctx, metrics)
+	keys := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		keys = append(keys, cacheKey(metric.MType, metric.ID))
+	}
+	c.Invalidate(keys...)
+	return err
+}
+
+// Invalidate drops cached values of "type/id" keys
+func (c *CachedStorage) Invalidate(keys ...string) {
+	for _, key := range keys {
+		c.bucket(key).Add(1)
+		c.entries.Remove(key)
+	}
+}
+
+// Purge drops every cached value
+func (c *CachedStorage) Purge() {
+	c.epoch.Add(1)
+	c.entries.Purge()
+}
+
+// Listen receives change notifications until ctx is done and enables the cache meanwhile.
+// notifications sent while disconnected are lost, so the cache is purged on every reconnect
+func (c *CachedStorage) Listen(ctx context.Context) {
+	policy := DefaultRetryPolicy()
+	for attempt := 1; ; attempt++ {
+		err := c.listen(ctx, func() { attempt = 0 })
+		c.live.Store(false)
+		c.Purge()
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := policy.delay(min(attempt, 10))
+		logger.FromContext(ctx).Warn("cache invalidation listener failed, reads bypass the cache", zap.Duration("retry_in", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// one listening session, connected is called once notifications flow
+func (c *CachedStorage) listen(ctx context.Context, connected func()) error {
+	conn, err := pgx.Connect(ctx, c.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+changesChannel); err != nil {
+		return err
+	}
+	c.Purge()
+	c.live.Store(true)
+	connected()
+	logger.FromContext(ctx).Info("cache invalidation listener connected")
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Payload == "*" {
+			c.Purge()
+			continue
+		}
+		c.Invalidate(strings.Split(n.Payload, "\n")...)
+	}
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counts reads reaching the wrapped storage
+type countingDB struct {
+	Database
+	returns atomic.Int64
+}
+
+func (c *countingDB) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	c.returns.Add(1)
+	return c.Database.Return(ctx, mtype, id)
+}
+
+func newTestCache(t *testing.T, opts CacheOptions) (*CachedStorage, *countingDB) {
+	t.Helper()
+	inner := &countingDB{Database: NewMemStorage()}
+	c := NewCachedStorage(inner, "", opts)
+	c.live.Store(true)
+	return c, inner
+}
+
+func TestCachedStorage(t *testing.T) {
+	ctx := context.Background()
+	c, inner := newTestCache(t, CacheOptions{Size: 10, TTL: time.Minute})
+	require.NoError(t, c.Update(ctx, "gauge", "load", 1.5))
+
+	for i := 0; i < 3; i++ {
+		m, err := c.Return(ctx, "gauge", "load")
+		require.NoError(t, err)
+		assert.Equal(t, 1.5, *m.Value)
+	}
+	assert.Equal(t, int64(1), inner.returns.Load(), "later reads are hits")
+
+	// callers do not share the cached value
+	m, _ := c.Return(ctx, "gauge", "load")
+	*m.Value = 100
+	m, _ = c.Return(ctx, "gauge", "load")
+	assert.Equal(t, 1.5, *m.Value)
+
+	require.NoError(t, c.Update(ctx, "gauge", "load", 2.5))
+	m, err := c.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, *m.Value, "writes invalidate")
+
+	one := int64(1)
+	require.NoError(t, c.UpdateBatch(ctx, collector.Metrics{{ID: "load", MType: "gauge", Value: new(float64)}, {ID: "requests", MType: "counter", Delta: &one}}))
+	m, err = c.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, *m.Value, "batches invalidate")
+
+	_, err = c.Return(ctx, "gauge", "missing")
+	assert.Error(t, err)
+	_, err = c.Return(ctx, "gauge", "missing")
+	assert.Error(t, err)
+	assert.Equal(t, int64(5), inner.returns.Load(), "errors are not cached")
+}
+
+func TestCachedStorageBypass(t *testing.T) {
+	ctx := context.Background()
+	c, inner := newTestCache(t, CacheOptions{Size: 10, TTL: time.Minute})
+	require.NoError(t, c.Update(ctx, "gauge", "load", 1.5))
+	c.live.Store(false)
+
+	for i := 0; i < 3; i++ {
+		_, err := c.Return(ctx, "gauge", "load")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(3), inner.returns.Load(), "without a listener every read goes to the database")
+}
+
+func TestCachedStorageInvalidate(t *testing.T) {
+	ctx := context.Background()
+	c, inner := newTestCache(t, CacheOptions{Size: 10, TTL: time.Minute})
+	require.NoError(t, c.Update(ctx, "gauge", "a", 1.0))
+	require.NoError(t, c.Update(ctx, "gauge", "b", 2.0))
+	c.Return(ctx, "gauge", "a")
+	c.Return(ctx, "gauge", "b")
+
+	// another replica wrote "a"
+	require.NoError(t, inner.Update(ctx, "gauge", "a", 3.0))
+	m, _ := c.Return(ctx, "gauge", "a")
+	assert.Equal(t, 1.0, *m.Value, "stale until notified")
+	c.Invalidate("gauge/a")
+	m, _ = c.Return(ctx, "gauge", "a")
+	assert.Equal(t, 3.0, *m.Value)
+
+	before := inner.returns.Load()
+	c.Purge()
+	c.Return(ctx, "gauge", "a")
+	c.Return(ctx, "gauge", "b")
+	assert.Equal(t, before+2, inner.returns.Load())
+}
+
+func TestCachedStorageBounds(t *testing.T) {
+	ctx := context.Background()
+	c, inner := newTestCache(t, CacheOptions{Size: 2, TTL: 50 * time.Millisecond})
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, c.Update(ctx, "gauge", id, 1.0))
+		c.Return(ctx, "gauge", id)
+	}
+	assert.Equal(t, 2, c.entries.Len(), "least recently used is evicted")
+
+	time.Sleep(100 * time.Millisecond)
+	before := inner.returns.Load()
+	c.Return(ctx, "gauge", "c")
+	assert.Equal(t, before+1, inner.returns.Load(), "expired entries are read again")
+}
+
+// a read that started before an invalidation must not cache what it read
+type racingDB struct {
+	Database
+	during func()
+}
+
+func (r *racingDB) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	m, err := r.Database.Return(ctx, mtype, id)
+	r.during()
+	return m, err
+}
+
+func TestCachedStorageReadRacesInvalidation(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	require.NoError(t, mem.Update(ctx, "gauge", "load", 1.0))
+	inner := &racingDB{Database: mem}
+	c := NewCachedStorage(inner, "", CacheOptions{Size: 10, TTL: time.Minute})
+	c.live.Store(true)
+	inner.during = func() {
+		mem.Update(ctx, "gauge", "load", 2.0)
+		c.Invalidate("gauge/load")
+	}
+
+	m, err := c.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *m.Value)
+	assert.Zero(t, c.entries.Len())
+}
+
+// steady writes to other series do not keep a read from being cached
+func TestCachedStorageReadRacesOtherWrites(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+	require.NoError(t, mem.Update(ctx, "gauge", "load", 1.0))
+	inner := &racingDB{Database: mem}
+	c := NewCachedStorage(inner, "", CacheOptions{Size: 10, TTL: time.Minute})
+	c.live.Store(true)
+
+	// a key in another bucket
+	other := "gauge/other"
+	for i := 0; c.bucket(other) == c.bucket("gauge/load"); i++ {
+		other = fmt.Sprintf("gauge/other%d", i)
+	}
+	inner.during = func() { c.Invalidate(other) }
+	_, err := c.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 1, c.entries.Len())
+
+	// a purge still drops reads in flight
+	c.Invalidate("gauge/load")
+	inner.during = c.Purge
+	_, err = c.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Zero(t, c.entries.Len())
+}
+
+// needs a disposable database, see TestPostgres in internal/schema
+func TestCachedStorageNotify(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// two replicas sharing one database
+	var replicas [2]*CachedStorage
+	for i := range replicas {
+		db, err := ConnectPgx(dsn, PoolConfig{})
+		require.NoError(t, err)
+		defer db.Close()
+		replicas[i] = NewCachedStorage(db, dsn, CacheOptions{Size: 10, TTL: time.Minute})
+		go replicas[i].Listen(ctx)
+	}
+	require.Eventually(t, func() bool {
+		return replicas[0].live.Load() && replicas[1].live.Load()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	id := fmt.Sprintf("cache_%d", os.Getpid())
+	defer replicas[0].Unwrap().(*PgxStorage).Pool.Exec(context.Background(), `DELETE FROM metrics WHERE id = $1;`, id)
+	require.NoError(t, replicas[0].Update(ctx, "gauge", id, 1.0))
+	m, err := replicas[1].Return(ctx, "gauge", id)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, *m.Value)
+
+	require.NoError(t, replicas[0].Update(ctx, "gauge", id, 2.0))
+	assert.Eventually(t, func() bool {
+		m, err := replicas[1].Return(ctx, "gauge", id)
+		return err == nil && *m.Value == 2.0
+	}, 5*time.Second, 10*time.Millisecond, "a write on one replica invalidates the other")
+
+	// a batch is announced in one notification listing every series
+	second := id + "_b"
+	defer replicas[0].Unwrap().(*PgxStorage).Pool.Exec(context.Background(), `DELETE FROM metrics WHERE id = $1;`, second)
+	require.NoError(t, replicas[0].Update(ctx, "gauge", second, 1.0))
+	replicas[1].Return(ctx, "gauge", second)
+	v := 3.0
+	require.NoError(t, replicas[0].UpdateBatch(ctx, collector.Metrics{
+		{ID: id, MType: "gauge", Value: &v},
+		{ID: second, MType: "gauge", Value: &v},
+	}))
+	assert.Eventually(t, func() bool {
+		a, errA := replicas[1].Return(ctx, "gauge", id)
+		b, errB := replicas[1].Return(ctx, "gauge", second)
+		return errA == nil && errB == nil && *a.Value == 3.0 && *b.Value == 3.0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+)
+
+// ErrInjected is returned by ChaosStorage instead of calling the storage
+var ErrInjected = errors.New("injected storage fault")
+
+// ChaosConfig sets how often faults are injected, rates are probabilities from 0 to 1
+type ChaosConfig struct {
+	Latency     time.Duration // added before an operation
+	LatencyRate float64
+	ErrorRate   float64
+}
+
+// ChaosStorage delays or fails operations at random, for resilience testing.
+// a failed operation never reaches the wrapped storage
+type ChaosStorage struct {
+	Database
+	cfg ChaosConfig
+}
+
+func NewChaosStorage(db Database, cfg ChaosConfig) *ChaosStorage {
+	return &ChaosStorage{Database: db, cfg: cfg}
+}
+
+func (s *ChaosStorage) Unwrap() Database {
+	return s.Database
+}
+
+// inject sleeps and picks a failure, a cancelled ctx cuts the sleep short
+func (s *ChaosStorage) inject(ctx context.Context) error {
+	if s.cfg.Latency > 0 && rand.Float64() < s.cfg.LatencyRate {
+		selfstats.FromContext(ctx).Inc("storage.chaos.delayed", 1)
+		t := time.NewTimer(s.cfg.Latency)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if rand.Float64() < s.cfg.ErrorRate {
+		selfstats.FromContext(ctx).Inc("storage.chaos.failed", 1)
+		return ErrInjected
+	}
+	return nil
+}
+
+func (s *ChaosStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	if err := s.inject(ctx); err != nil {
+		return err
+	}
+	return s.Database.Update(ctx, mtype, id, value)
+}
+
+func (s *ChaosStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	if err := s.inject(ctx); err != nil {
+		return err
+	}
+	return s.Database.UpdateBatch(ctx, metrics)
+}
+
+func (s *ChaosStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.Database.Return(ctx, mtype, id)
+}
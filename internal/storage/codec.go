@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SnapshotCodec encodes snapshot bodies one metric at a time
+type SnapshotCodec interface {
+	Name() string
+	NewEncoder(w io.Writer) MetricEncoder
+	NewDecoder(r io.Reader) MetricDecoder
+}
+
+type MetricEncoder interface {
+	Encode(metric collector.Metric) error
+	// Close finishes the body, the underlying writer is left open
+	Close() error
+}
+
+// MetricDecoder returns io.EOF after the last metric
+type MetricDecoder interface {
+	Decode() (collector.Metric, error)
+}
+
+var codecs = map[string]SnapshotCodec{}
+
+// file extensions mapped to codec names
+var codecExtensions = map[string]string{}
+
+// RegisterSnapshotCodec makes a codec available for writing and restoring snapshots
+func RegisterSnapshotCodec(codec SnapshotCodec, extensions ...string) {
+	codecs[codec.Name()] = codec
+	for _, ext := range extensions {
+		codecExtensions[ext] = codec.Name()
+	}
+}
+
+func init() {
+	RegisterSnapshotCodec(jsonCodec{}, ".json")
+	RegisterSnapshotCodec(gobCodec{}, ".gob")
+	RegisterSnapshotCodec(protobufCodec{}, ".pb", ".protobuf")
+}
+
+// SnapshotCodecs lists registered codec names
+func SnapshotCodecs() []string {
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CodecFor returns the codec with the given name,
+// an empty name picks it by file extension and defaults to json
+func CodecFor(name, filename string) (SnapshotCodec, error) {
+	if name == "" {
+		name = codecExtensions[strings.ToLower(filepath.Ext(filename))]
+	}
+	if name == "" {
+		name = "json"
+	}
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown snapshot format %q, want one of %s", name, strings.Join(SnapshotCodecs(), ", "))
+	}
+	return codec, nil
+}
+
+// ----- JSON -----
+
+// json array, one metric per line, compatible with version 1 snapshots
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) NewEncoder(w io.Writer) MetricEncoder {
+	return &jsonEncoder{w: w}
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) MetricDecoder {
+	return &jsonDecoder{dec: json.NewDecoder(r)}
+}
+
+type jsonEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonEncoder) Encode(metric collector.Metric) error {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if e.count == 0 {
+		sep = "[\n  "
+	}
+	e.count++
+	if _, err := io.WriteString(e.w, sep); err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonEncoder) Close() error {
+	end := "\n]"
+	if e.count == 0 {
+		end = "[]"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+type jsonDecoder struct {
+	dec     *json.Decoder
+	started bool
+}
+
+func (d *jsonDecoder) Decode() (collector.Metric, error) {
+	var metric collector.Metric
+	if !d.started {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return metric, err
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return metric, fmt.Errorf("expected json array, got %v", tok)
+		}
+		d.started = true
+	}
+	if !d.dec.More() {
+		if _, err := d.dec.Token(); err != nil {
+			return metric, err
+		}
+		return metric, io.EOF
+	}
+	err := d.dec.Decode(&metric)
+	return metric, err
+}
+
+// ----- GOB -----
+
+// gob drops zero values, so pointers are flattened to keep a zero gauge
+type gobMetric struct {
+	ID    string
+	MType string
+	Value float64
+	Delta int64
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) NewEncoder(w io.Writer) MetricEncoder {
+	return gobEncoder{enc: gob.NewEncoder(w)}
+}
+
+func (gobCodec) NewDecoder(r io.Reader) MetricDecoder {
+	return gobDecoder{dec: gob.NewDecoder(r)}
+}
+
+type gobEncoder struct {
+	enc *gob.Encoder
+}
+
+func (e gobEncoder) Encode(metric collector.Metric) error {
+	m := gobMetric{ID: metric.ID, MType: metric.MType}
+	if metric.Value != nil {
+		m.Value = *metric.Value
+	}
+	if metric.Delta != nil {
+		m.Delta = *metric.Delta
+	}
+	return e.enc.Encode(m)
+}
+
+func (gobEncoder) Close() error { return nil }
+
+type gobDecoder struct {
+	dec *gob.Decoder
+}
+
+func (d gobDecoder) Decode() (collector.Metric, error) {
+	var m gobMetric
+	if err := d.dec.Decode(&m); err != nil {
+		return collector.Metric{}, err
+	}
+	return newMetric(m.ID, m.MType, m.Value, m.Delta), nil
+}
+
+// ----- PROTOBUF -----
+
+// length-delimited messages of
+//
+//	message Metric {
+//	  string id = 1;
+//	  string type = 2;
+//	  double value = 3;
+//	  sint64 delta = 4;
+//	}
+type protobufCodec struct{}
+
+const (
+	pbID    protowire.Number = 1
+	pbType  protowire.Number = 2
+	pbValue protowire.Number = 3
+	pbDelta protowire.Number = 4
+)
+
+func (protobufCodec) Name() string { return "protobuf" }
+
+func (protobufCodec) NewEncoder(w io.Writer) MetricEncoder {
+	return &protobufEncoder{w: w}
+}
+
+func (protobufCodec) NewDecoder(r io.Reader) MetricDecoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &protobufDecoder{r: br}
+}
+
+type protobufEncoder struct {
+	w   io.Writer
+	msg []byte
+	buf []byte
+}
+
+func (e *protobufEncoder) Encode(metric collector.Metric) error {
+	e.msg = protowire.AppendTag(e.msg[:0], pbID, protowire.BytesType)
+	e.msg = protowire.AppendString(e.msg, metric.ID)
+	e.msg = protowire.AppendTag(e.msg, pbType, protowire.BytesType)
+	e.msg = protowire.AppendString(e.msg, metric.MType)
+	if metric.Value != nil {
+		e.msg = protowire.AppendTag(e.msg, pbValue, protowire.Fixed64Type)
+		e.msg = protowire.AppendFixed64(e.msg, math.Float64bits(*metric.Value))
+	}
+	if metric.Delta != nil {
+		e.msg = protowire.AppendTag(e.msg, pbDelta, protowire.VarintType)
+		e.msg = protowire.AppendVarint(e.msg, protowire.EncodeZigZag(*metric.Delta))
+	}
+	e.buf = protowire.AppendBytes(e.buf[:0], e.msg)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+func (*protobufEncoder) Close() error { return nil }
+
+type protobufDecoder struct {
+	r   *bufio.Reader
+	msg []byte
+}
+
+func (d *protobufDecoder) Decode() (collector.Metric, error) {
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return collector.Metric{}, err
+	}
+	if size > walMaxRecord {
+		return collector.Metric{}, fmt.Errorf("message of %d bytes", size)
+	}
+	if cap(d.msg) < int(size) {
+		d.msg = make([]byte, size)
+	}
+	d.msg = d.msg[:size]
+	if _, err := io.ReadFull(d.r, d.msg); err != nil {
+		return collector.Metric{}, io.ErrUnexpectedEOF
+	}
+
+	var (
+		id, mtype string
+		value     float64
+		delta     int64
+	)
+	b := d.msg
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return collector.Metric{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == pbID && typ == protowire.BytesType:
+			id, n = protowire.ConsumeString(b)
+		case num == pbType && typ == protowire.BytesType:
+			mtype, n = protowire.ConsumeString(b)
+		case num == pbValue && typ == protowire.Fixed64Type:
+			var bits uint64
+			bits, n = protowire.ConsumeFixed64(b)
+			value = math.Float64frombits(bits)
+		case num == pbDelta && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			delta = protowire.DecodeZigZag(v)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return collector.Metric{}, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return newMetric(id, mtype, value, delta), nil
+}
+
+func newMetric(id, mtype string, value float64, delta int64) collector.Metric {
+	metric := collector.Metric{ID: id, MType: mtype}
+	switch mtype {
+	case "gauge":
+		metric.Value = &value
+	case "counter":
+		metric.Delta = &delta
+	}
+	return metric
+}
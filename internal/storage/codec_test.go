@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotCodecs(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range SnapshotCodecs() {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "metrics.snap")
+			s := NewMemStorage()
+			s.SnapshotFormat = name
+			require.NoError(t, s.Update(ctx, "gauge", "Alloc", 1.5))
+			require.NoError(t, s.Update(ctx, "gauge", "Zero", 0.0))
+			require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(-3)))
+			require.NoError(t, s.Write(file))
+
+			restored := NewMemStorage()
+			require.NoError(t, restored.Restore(file))
+			assert.ElementsMatch(t, s.Snapshot(), restored.Snapshot())
+
+			// empty store
+			require.NoError(t, NewMemStorage().Write(file))
+			require.NoError(t, NewMemStorage().Restore(file))
+		})
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		format   string
+		filename string
+		want     string
+		wantErr  bool
+	}{
+		{filename: "db.json", want: "json"},
+		{filename: "db.gob", want: "gob"},
+		{filename: "db.PB", want: "protobuf"},
+		{filename: "db", want: "json"},
+		{format: "gob", filename: "db.json", want: "gob"},
+		{format: "xml", filename: "db.json", wantErr: true},
+	}
+	for _, tt := range tests {
+		codec, err := CodecFor(tt.format, tt.filename)
+		if tt.wantErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, codec.Name())
+	}
+}
+
+// version 1 snapshots have no encoding and an unpadded header
+func TestSnapshotVersion1(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	v := 2.5
+	body, err := json.MarshalIndent(collector.Metrics{{ID: "Alloc", MType: "gauge", Value: &v}}, "", "  ")
+	require.NoError(t, err)
+	sum := sha256.Sum256(body)
+	header := fmt.Sprintf(`{"format":"metrics-snapshot","version":1,"created":"2024-01-01T00:00:00Z","count":1,"checksum":"%s"}`, hex.EncodeToString(sum[:]))
+	require.NoError(t, os.WriteFile(file, append([]byte(header+"\n"), body...), 0644))
+
+	s := NewMemStorage()
+	require.NoError(t, s.Restore(file))
+	m, err := s.Return(context.Background(), "gauge", "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, *m.Value)
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	const series = 100_000
+	s := NewMemStorage()
+	ctx := context.Background()
+	for i := 0; i < series; i++ {
+		s.Update(ctx, "gauge", fmt.Sprintf("gauge_%d", i), float64(i)/3)
+		s.Update(ctx, "counter", fmt.Sprintf("counter_%d", i), int64(i))
+	}
+
+	for _, name := range SnapshotCodecs() {
+		file := filepath.Join(b.TempDir(), "metrics.snap")
+		s.SnapshotFormat = name
+		s.SnapshotKeep = 1
+
+		b.Run(name+"/write", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := s.Write(file); err != nil {
+					b.Fatal(err)
+				}
+			}
+			info, _ := os.Stat(file)
+			b.ReportMetric(float64(info.Size()), "file-bytes")
+		})
+		b.Run(name+"/restore", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := NewMemStorage().Restore(file); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Decorator wraps a storage with cross-cutting behaviour, the result must implement Unwrap
+type Decorator func(Database) Database
+
+// Chain wraps db so that the first decorator is the outermost one
+func Chain(db Database, decorators ...Decorator) Database {
+	for i := len(decorators) - 1; i >= 0; i-- {
+		db = decorators[i](db)
+	}
+	return db
+}
+
+// WithStats records latency and errors under _server.storage.<backend>.<op>
+func WithStats(backend string) Decorator {
+	return func(db Database) Database {
+		return Instrument(db, backend)
+	}
+}
+
+// WithLogging logs every operation at debug level
+func WithLogging(log *zap.Logger) Decorator {
+	return func(db Database) Database {
+		return NewLoggedStorage(db, log)
+	}
+}
+
+// WithTracing starts a span for every operation
+func WithTracing(tp trace.TracerProvider) Decorator {
+	return func(db Database) Database {
+		return NewTracedStorage(db, tp)
+	}
+}
+
+// WithChaos injects latency and errors, see ChaosConfig
+func WithChaos(cfg ChaosConfig) Decorator {
+	return func(db Database) Database {
+		return NewChaosStorage(db, cfg)
+	}
+}
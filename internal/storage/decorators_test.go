@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestChain(t *testing.T) {
+	mem := NewMemStorage()
+	db := Chain(mem, WithStats("memory"), WithLogging(zap.NewNop()), WithChaos(ChaosConfig{}))
+
+	require.IsType(t, &InstrumentedStorage{}, db)
+	logged, ok := As[*LoggedStorage](db)
+	require.True(t, ok)
+	assert.IsType(t, &ChaosStorage{}, logged.Unwrap())
+	assert.Same(t, mem, Unwrap(db))
+	assert.Same(t, mem, Chain(mem))
+}
+
+func TestLoggedStorage(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zap.DebugLevel)
+	db := NewLoggedStorage(NewMemStorage(), zap.New(core))
+
+	require.NoError(t, db.Update(ctx, "gauge", "load", 1.5))
+	require.NoError(t, db.UpdateBatch(ctx, collector.Metrics{}))
+	_, err := db.Return(ctx, "gauge", "missing")
+	require.Error(t, err)
+
+	entries := logs.AllUntimed()
+	require.Len(t, entries, 3)
+	assert.Equal(t, "storage update", entries[0].Message)
+	assert.Equal(t, "load", entries[0].ContextMap()["id"])
+	assert.Equal(t, int64(0), entries[1].ContextMap()["size"])
+	assert.Contains(t, entries[2].ContextMap(), "error")
+
+	// nothing is built above debug
+	core, logs = observer.New(zap.InfoLevel)
+	db = NewLoggedStorage(NewMemStorage(), zap.New(core))
+	require.NoError(t, db.Update(ctx, "gauge", "load", 1.5))
+	assert.Zero(t, logs.Len())
+}
+
+func TestTracedStorage(t *testing.T) {
+	ctx := context.Background()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	db := NewTracedStorage(NewMemStorage(), tp)
+
+	parentCtx, parent := tp.Tracer("test").Start(ctx, "request")
+	require.NoError(t, db.Update(parentCtx, "counter", "requests", int64(1)))
+	parent.End()
+	_, err := db.Return(ctx, "counter", "missing")
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	update, ret := spans[0], spans[2]
+	assert.Equal(t, "storage.update", update.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), update.Parent().SpanID(), "child of the span in ctx")
+	assert.Equal(t, codes.Unset, update.Status().Code)
+	assert.Equal(t, "storage.return", ret.Name())
+	assert.Equal(t, codes.Error, ret.Status().Code)
+	assert.Len(t, ret.Events(), 1, "error is recorded")
+}
+
+func TestChaosStorage(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemStorage()
+
+	failing := NewChaosStorage(mem, ChaosConfig{ErrorRate: 1})
+	assert.ErrorIs(t, failing.Update(ctx, "gauge", "load", 1.5), ErrInjected)
+	assert.ErrorIs(t, failing.UpdateBatch(ctx, collector.Metrics{}), ErrInjected)
+	_, err := mem.Return(ctx, "gauge", "load")
+	assert.Error(t, err, "failed writes never reach the storage")
+
+	passing := NewChaosStorage(mem, ChaosConfig{})
+	require.NoError(t, passing.Update(ctx, "gauge", "load", 1.5))
+	m, err := passing.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	slow := NewChaosStorage(mem, ChaosConfig{Latency: 50 * time.Millisecond, LatencyRate: 1})
+	start := time.Now()
+	_, err = slow.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// cancelling stops the injected delay
+	slow = NewChaosStorage(mem, ChaosConfig{Latency: time.Hour, LatencyRate: 1})
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = slow.Return(cancelled, "gauge", "load")
+	assert.ErrorIs(t, err, context.Canceled)
+}
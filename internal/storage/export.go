@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+)
+
+// ErrSnapshotUnsupported is returned for backends without export and import
+var ErrSnapshotUnsupported = errors.New("storage does not support snapshots")
+
+// Snapshotter is implemented by backends that can export and import all series at once
+type Snapshotter interface {
+	// Export returns a consistent point-in-time copy of every series
+	Export(ctx context.Context) (collector.Metrics, error)
+	// Import sets series to the given values, replace drops all other series first
+	Import(ctx context.Context, metrics collector.Metrics, replace bool) error
+}
+
+// Taker is implemented by backends that can give series away, e.g. once they moved to another node
+type Taker interface {
+	// Take removes exported values and keeps whatever was written since the export:
+	// counters lose the exported delta and are dropped once nothing is left,
+	// gauges are dropped only while they still hold the exported value
+	Take(ctx context.Context, metrics collector.Metrics) error
+}
+
+// ExportFile writes a snapshot of db to filename, it can be loaded with ImportFile
+// or used as the storage file of a memory backend.
+// The outermost layer that exports decides, e.g. a cluster node refuses
+func ExportFile(ctx context.Context, db Database, filename string, codec SnapshotCodec) (SnapshotHeader, error) {
+	s, ok := As[Snapshotter](db)
+	if !ok {
+		return SnapshotHeader{}, ErrSnapshotUnsupported
+	}
+	metrics, err := s.Export(ctx)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	return writeSnapshot(filename, codec, metrics, 0, 1)
+}
+
+// ImportFile verifies a snapshot file of any format and loads it into db
+func ImportFile(ctx context.Context, db Database, filename string, replace bool) (SnapshotHeader, error) {
+	s, ok := As[Snapshotter](db)
+	if !ok {
+		return SnapshotHeader{}, ErrSnapshotUnsupported
+	}
+	// an empty file would wipe everything in replace mode
+	if info, err := os.Stat(filename); err != nil {
+		return SnapshotHeader{}, err
+	} else if info.Size() == 0 {
+		return SnapshotHeader{}, fmt.Errorf("%w: empty file", ErrCorruptSnapshot)
+	}
+
+	var metrics collector.Metrics
+	var invalid error
+	header, err := readSnapshot(filename, func(metric collector.Metric) {
+		if err := validSnapshotMetric(metric); err != nil && invalid == nil {
+			invalid = err
+		}
+		metrics = append(metrics, metric)
+	})
+	if err == nil && invalid != nil {
+		err = fmt.Errorf("%w: %v", ErrCorruptSnapshot, invalid)
+	}
+	if err != nil {
+		return header, err
+	}
+	header.Count = len(metrics)
+	return header, s.Import(ctx, metrics, replace)
+}
+
+func validSnapshotMetric(metric collector.Metric) error {
+	switch {
+	case metric.ID == "":
+		return errors.New("metric without id")
+	case metric.MType == "gauge" && metric.Value != nil:
+		return nil
+	case metric.MType == "counter" && metric.Delta != nil:
+		return nil
+	}
+	return fmt.Errorf("invalid metric %q of type %q", metric.ID, metric.MType)
+}
+
+// ----- MEMORY STORAGE -----
+
+// Export copies every series with all shards locked at once
+func (s *MemStorage) Export(ctx context.Context) (collector.Metrics, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.RUnlock()
+		}
+	}()
+
+	var metrics collector.Metrics
+	for _, sh := range s.shards {
+		for id, value := range sh.gauge {
+			v := value
+			metrics = append(metrics, collector.Metric{ID: id, MType: "gauge", Value: &v})
+		}
+		for id, delta := range sh.counter {
+			d := delta
+			metrics = append(metrics, collector.Metric{ID: id, MType: "counter", Delta: &d})
+		}
+	}
+	return metrics, nil
+}
+
+// Import sets series atomically, it is logged to the wal like any other update
+func (s *MemStorage) Import(ctx context.Context, metrics collector.Metrics, replace bool) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if s.wal != nil {
+		op := walSet
+		if replace {
+			op = walReplace
+		}
+		s.walMu.RLock()
+		defer s.walMu.RUnlock()
+		if err := s.wal.append(op, metrics); err != nil {
+			return err
+		}
+	}
+	s.load(metrics, replace)
+	return nil
+}
+
+// load sets series with all shards locked, so readers see either none or all of them
+func (s *MemStorage) load(metrics collector.Metrics, replace bool) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.Unlock()
+		}
+	}()
+
+	if replace {
+		for _, sh := range s.shards {
+			sh.gauge = make(map[string]float64)
+			sh.counter = make(map[string]int64)
+		}
+	}
+	for _, metric := range metrics {
+		sh := s.shard(metric.ID)
+		switch metric.MType {
+		case "gauge":
+			sh.gauge[metric.ID] = *metric.Value
+		case "counter":
+			sh.counter[metric.ID] = *metric.Delta
+		}
+	}
+	if s.Events != nil {
+		s.Events.Publish(metrics...)
+	}
+}
+
+// Take removes exported values, it is logged to the wal like any other update
+func (s *MemStorage) Take(ctx context.Context, metrics collector.Metrics) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if s.wal != nil {
+		s.walMu.RLock()
+		defer s.walMu.RUnlock()
+		if err := s.wal.append(walTake, metrics); err != nil {
+			return err
+		}
+	}
+	s.take(metrics)
+	return nil
+}
+
+func (s *MemStorage) take(metrics collector.Metrics) {
+	for _, metric := range metrics {
+		sh := s.shard(metric.ID)
+		sh.mu.Lock()
+		switch metric.MType {
+		case "gauge":
+			if v, ok := sh.gauge[metric.ID]; ok && v == *metric.Value {
+				delete(sh.gauge, metric.ID)
+			}
+		case "counter":
+			if d, ok := sh.counter[metric.ID]; ok {
+				if d -= *metric.Delta; d == 0 {
+					delete(sh.counter, metric.ID)
+				} else {
+					sh.counter[metric.ID] = d
+				}
+			}
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// ----- POSTGRES DATABASE -----
+
+// Export reads every series in a single statement, which sees one snapshot of the table
+func (db DBStorage) Export(ctx context.Context) (collector.Metrics, error) {
+	selectQuery := `
+	SELECT id, mtype, value, delta
+	FROM metrics
+	ORDER BY id;`
+
+	var metrics collector.Metrics
+	err := withRetry(ctx, db.Resilience, func() error {
+		metrics = metrics[:0]
+		rows, err := db.QueryContext(ctx, selectQuery)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var metric collector.Metric
+			if err := rows.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta); err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// Import sets series in one transaction
+func (db DBStorage) Import(ctx context.Context, metrics collector.Metrics, replace bool) error {
+	insertQuery := `
+	INSERT INTO metrics (id, mtype, value, delta)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (id) DO UPDATE
+		SET mtype = EXCLUDED.mtype, value = EXCLUDED.value, delta = EXCLUDED.delta;`
+
+	err := withRetry(ctx, db.Resilience, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if replace {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM metrics;`); err != nil {
+				return err
+			}
+		}
+		stmt, err := tx.PrepareContext(ctx, insertQuery)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, metric := range metrics {
+			if _, err := stmt.ExecContext(ctx, metric.ID, metric.MType, metric.Value, metric.Delta); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	db.Events.Publish(metrics...)
+	return nil
+}
+
+// Take runs in one transaction: exported deltas are subtracted from counters,
+// then counters with nothing left and gauges still holding the exported value are dropped.
+// series are passed as arrays of ids and values
+const (
+	takeCountersQuery = `
+	UPDATE metrics m SET delta = m.delta - t.delta
+	FROM unnest($1::text[], $2::bigint[]) AS t(id, delta)
+	WHERE m.id = t.id AND m.mtype = 'counter';`
+	dropCountersQuery = `
+	DELETE FROM metrics
+	WHERE mtype = 'counter' AND delta = 0 AND id = ANY($1::text[]);`
+	dropGaugesQuery = `
+	DELETE FROM metrics m
+	USING unnest($1::text[], $2::double precision[]) AS t(id, value)
+	WHERE m.id = t.id AND m.mtype = 'gauge' AND m.value = t.value;`
+)
+
+type takeArgs struct {
+	counters []string
+	deltas   []int64
+	gauges   []string
+	values   []float64
+}
+
+func newTakeArgs(metrics collector.Metrics) takeArgs {
+	var args takeArgs
+	for _, metric := range metrics {
+		switch metric.MType {
+		case "counter":
+			args.counters = append(args.counters, metric.ID)
+			args.deltas = append(args.deltas, *metric.Delta)
+		case "gauge":
+			args.gauges = append(args.gauges, metric.ID)
+			args.values = append(args.values, *metric.Value)
+		}
+	}
+	return args
+}
+
+// Take removes exported values in one transaction
+func (db DBStorage) Take(ctx context.Context, metrics collector.Metrics) error {
+	args := newTakeArgs(metrics)
+	return withRetry(ctx, db.Resilience, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, takeCountersQuery, args.counters, args.deltas); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, dropCountersQuery, args.counters); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, dropGaugesQuery, args.gauges, args.values); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
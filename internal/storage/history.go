@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"go.uber.org/zap"
+)
+
+// ErrHistoryUnsupported is returned for backends that keep no samples
+var ErrHistoryUnsupported = errors.New("storage keeps no history")
+
+// Sample is a series value at a point in time, counters hold the running total
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value *float64  `json:"value,omitempty"`
+	Delta *int64    `json:"delta,omitempty"`
+}
+
+// HistoryReader is implemented by backends that keep samples
+type HistoryReader interface {
+	// Range returns samples of a series with from <= time < to, oldest first
+	Range(ctx context.Context, mtype string, id string, from, to time.Time) ([]Sample, error)
+}
+
+// Maintainer is implemented by backends with periodic housekeeping, Maintain returns once ctx is done
+type Maintainer interface {
+	Maintain(ctx context.Context, interval time.Duration)
+}
+
+// Partitioning of metric_samples
+type Partitioning struct {
+	Period    string        // "day" or "week"
+	Ahead     int           // partitions created past the current one
+	Retention time.Duration // partitions ending before now-Retention are dropped, 0 keeps all
+}
+
+const samplesTable = "metric_samples"
+
+// period start containing t, weeks start on monday, always utc
+func (p Partitioning) start(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if p.Period == "week" {
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return day
+}
+
+func (p Partitioning) next(start time.Time) time.Time {
+	if p.Period == "week" {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// partition name encodes period and start, e.g. metric_samples_d20261019
+func partitionName(period string, start time.Time) string {
+	return fmt.Sprintf("%s_%s%s", samplesTable, period[:1], start.Format("20060102"))
+}
+
+// start and end of a partition by its name
+func parsePartition(name string) (time.Time, time.Time, bool) {
+	rest, ok := strings.CutPrefix(name, samplesTable+"_")
+	if !ok || len(rest) != 9 {
+		return time.Time{}, time.Time{}, false
+	}
+	start, err := time.Parse("20060102", rest[1:])
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	switch rest[0] {
+	case 'd':
+		return start, start.AddDate(0, 0, 1), true
+	case 'w':
+		return start, start.AddDate(0, 0, 7), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// HistoryStorage keeps every update as a sample in time partitioned metric_samples,
+// the metrics table stays the current value cache that Return and Export read
+type HistoryStorage struct {
+	*DBStorage
+	Partitioning Partitioning
+}
+
+// upsert and sample insert in one statement, so a sample is written only with its current value
+const (
+	gaugeSampleQuery = `
+	WITH cur AS (
+		INSERT INTO metrics (id, mtype, value, delta)
+		VALUES ($1, $2, $3, NULL)
+		ON CONFLICT (id) DO UPDATE
+			SET value = EXCLUDED.value, delta = NULL
+		RETURNING id, mtype, value
+	)
+	INSERT INTO metric_samples (id, mtype, ts, value)
+	SELECT id, mtype, now(), value FROM cur;`
+
+	counterSampleQuery = `
+	WITH cur AS (
+		INSERT INTO metrics (id, mtype, value, delta)
+		VALUES ($1, $2, NULL, $3)
+		ON CONFLICT (id) DO UPDATE
+			SET value = NULL, delta = COALESCE(metrics.delta, 0) + EXCLUDED.delta
+		RETURNING id, mtype, delta
+	)
+	INSERT INTO metric_samples (id, mtype, ts, delta)
+	SELECT id, mtype, now(), delta FROM cur
+	RETURNING delta;`
+)
+
+func (h *HistoryStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	switch mtype {
+	case "gauge":
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("type assertion error while updating database")
+		}
+		err := h.withPartitions(ctx, func() error {
+			_, err := h.ExecContext(ctx, gaugeSampleQuery, id, mtype, v)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		h.Events.Publish(collector.Metric{ID: id, MType: mtype, Value: &v})
+		return nil
+
+	case "counter":
+		v, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("type assertion error while updating database")
+		}
+		var total int64
+		err := h.withPartitions(ctx, func() error {
+			return h.QueryRowContext(ctx, counterSampleQuery, id, mtype, v).Scan(&total)
+		})
+		if err != nil {
+			return err
+		}
+		h.Events.Publish(collector.Metric{ID: id, MType: mtype, Delta: &total})
+		return nil
+	default:
+		return fmt.Errorf("unknown metric type: %s", mtype)
+	}
+}
+
+// UpdateBatch writes current values and one sample per series in one transaction
+func (h *HistoryStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	merged, err := mergeBatch(metrics)
+	if err != nil {
+		return err
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	changed := make(collector.Metrics, 0, len(merged))
+	err = h.withPartitions(ctx, func() error {
+		changed = changed[:0]
+		tx, err := h.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		gaugeStmt, err := tx.PrepareContext(ctx, gaugeSampleQuery)
+		if err != nil {
+			return err
+		}
+		defer gaugeStmt.Close()
+		counterStmt, err := tx.PrepareContext(ctx, counterSampleQuery)
+		if err != nil {
+			return err
+		}
+		defer counterStmt.Close()
+
+		for _, metric := range merged {
+			switch metric.MType {
+			case "gauge":
+				if _, err := gaugeStmt.ExecContext(ctx, metric.ID, metric.MType, *metric.Value); err != nil {
+					return err
+				}
+				changed = append(changed, metric)
+			case "counter":
+				var total int64
+				if err := counterStmt.QueryRowContext(ctx, metric.ID, metric.MType, *metric.Delta).Scan(&total); err != nil {
+					return err
+				}
+				changed = append(changed, collector.Metric{ID: metric.ID, MType: metric.MType, Delta: &total})
+			}
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	h.Events.Publish(changed...)
+	return nil
+}
+
+// Range reads samples, the ts bounds let postgres prune partitions outside [from, to)
+func (h *HistoryStorage) Range(ctx context.Context, mtype string, id string, from, to time.Time) ([]Sample, error) {
+	selectQuery := `
+	SELECT ts, value, delta
+	FROM metric_samples
+	WHERE id = $1 AND mtype = $2 AND ts >= $3 AND ts < $4
+	ORDER BY ts;`
+
+	var samples []Sample
+	err := withRetry(ctx, h.Resilience, func() error {
+		samples = samples[:0]
+		rows, err := h.QueryContext(ctx, selectQuery, id, mtype, from, to)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s Sample
+			if err := rows.Scan(&s.Time, &s.Value, &s.Delta); err != nil {
+				return err
+			}
+			samples = append(samples, s)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// runs fn with retries, a sample past the last partition creates partitions and tries again
+func (h *HistoryStorage) withPartitions(ctx context.Context, fn func() error) error {
+	err := withRetry(ctx, h.Resilience, fn)
+	if !missingPartition(err) {
+		return err
+	}
+	if err := h.EnsurePartitions(ctx, time.Now()); err != nil {
+		return err
+	}
+	return withRetry(ctx, h.Resilience, fn)
+}
+
+func missingPartition(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.CheckViolation &&
+		strings.Contains(pgErr.Message, "no partition")
+}
+
+// EnsurePartitions creates the partition holding now and Ahead partitions after it
+func (h *HistoryStorage) EnsurePartitions(ctx context.Context, now time.Time) error {
+	p := h.Partitioning
+	start := p.start(now)
+	for i := 0; i <= p.Ahead; i++ {
+		end := p.next(start)
+		name := partitionName(p.Period, start)
+		createQuery := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s');`,
+			name, samplesTable, start.Format(time.RFC3339), end.Format(time.RFC3339))
+		err := withRetry(ctx, h.Resilience, func() error {
+			_, err := h.ExecContext(ctx, createQuery)
+			return err
+		})
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.InvalidObjectDefinition {
+			// overlaps a partition made with another period, that one already covers the range
+			logger.FromContext(ctx).Warn("skipping overlapping partition", zap.String("partition", name), zap.Error(err))
+		} else if err != nil {
+			return fmt.Errorf("creating partition %s: %w", name, err)
+		}
+		start = end
+	}
+	return nil
+}
+
+// DropExpired drops partitions whose whole range is older than the retention
+func (h *HistoryStorage) DropExpired(ctx context.Context, now time.Time) ([]string, error) {
+	if h.Partitioning.Retention <= 0 {
+		return nil, nil
+	}
+	listQuery := `
+	SELECT c.relname
+	FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	JOIN pg_class p ON p.oid = i.inhparent
+	WHERE p.relname = $1;`
+
+	var names []string
+	err := withRetry(ctx, h.Resilience, func() error {
+		names = names[:0]
+		rows, err := h.QueryContext(ctx, listQuery, samplesTable)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := now.Add(-h.Partitioning.Retention)
+	var dropped []string
+	for _, name := range names {
+		_, end, ok := parsePartition(name)
+		if !ok || end.After(cutoff) {
+			continue
+		}
+		err := withRetry(ctx, h.Resilience, func() error {
+			_, err := h.ExecContext(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s;`, name))
+			return err
+		})
+		if err != nil {
+			return dropped, fmt.Errorf("dropping partition %s: %w", name, err)
+		}
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
+
+// Maintain creates and drops partitions every interval until ctx is done
+func (h *HistoryStorage) Maintain(ctx context.Context, interval time.Duration) {
+	log := logger.FromContext(ctx)
+	for {
+		now := time.Now()
+		if err := h.EnsurePartitions(ctx, now); err != nil {
+			log.Error("error while creating partitions", zap.Error(err))
+		}
+		dropped, err := h.DropExpired(ctx, now)
+		if err != nil {
+			log.Error("error while dropping partitions", zap.Error(err))
+		}
+		if len(dropped) > 0 {
+			log.Info("dropped expired partitions", zap.Strings("partitions", dropped))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ConnectHistory connects like Connect and creates partitions for the current period
+func ConnectHistory(dsn string, pool PoolConfig, partitioning Partitioning) (*HistoryStorage, error) {
+	return connectHistory(context.Background(), dsn, pool, partitioning)
+}
+
+// connectHistory is ConnectHistory reporting through the logger and stats of parent
+func connectHistory(parent context.Context, dsn string, pool PoolConfig, partitioning Partitioning) (*HistoryStorage, error) {
+	db, err := connect(parent, "pgx", dsn, pool)
+	if err != nil {
+		return nil, err
+	}
+	h := &HistoryStorage{DBStorage: db, Partitioning: partitioning}
+	ctx, cancel := context.WithTimeout(parent, migrateTimeout)
+	defer cancel()
+	if err := h.EnsurePartitions(ctx, time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Range of db, ErrHistoryUnsupported if it keeps no samples
+func Range(ctx context.Context, db Database, mtype string, id string, from, to time.Time) ([]Sample, error) {
+	h, ok := Unwrap(db).(HistoryReader)
+	if !ok {
+		return nil, ErrHistoryUnsupported
+	}
+	return h.Range(ctx, mtype, id, from, to)
+}
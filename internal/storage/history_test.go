@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitioning(t *testing.T) {
+	// sunday evening in UTC+3 is still sunday in utc
+	at := time.Date(2026, 10, 18, 23, 30, 0, 0, time.FixedZone("", 3*3600))
+
+	day := Partitioning{Period: "day"}
+	start := day.start(at)
+	assert.Equal(t, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, "metric_samples_d20261018", partitionName(day.Period, start))
+
+	week := Partitioning{Period: "week"}
+	start = week.start(at)
+	assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), start, "weeks start on monday")
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), week.next(start))
+
+	from, to, ok := parsePartition(partitionName(week.Period, start))
+	require.True(t, ok)
+	assert.Equal(t, start, from)
+	assert.Equal(t, week.next(start), to)
+
+	for _, name := range []string{"metrics", "metric_samples_x20261012", "metric_samples_d2026101", "metric_samples_dabcdefgh"} {
+		_, _, ok := parsePartition(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestHistoryPartitionMaintenance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	h := &HistoryStorage{
+		DBStorage:    &DBStorage{DB: db},
+		Partitioning: Partitioning{Period: "day", Ahead: 1, Retention: 48 * time.Hour},
+	}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS metric_samples_d20261019 PARTITION OF metric_samples FOR VALUES FROM ('2026-10-19T00:00:00Z') TO ('2026-10-20T00:00:00Z')`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS metric_samples_d20261020 PARTITION OF`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	require.NoError(t, h.EnsurePartitions(context.Background(), now))
+
+	// only partitions ending before now-retention go
+	mock.ExpectQuery(`SELECT c.relname`).WithArgs("metric_samples").
+		WillReturnRows(sqlmock.NewRows([]string{"relname"}).
+			AddRow("metric_samples_d20261016").
+			AddRow("metric_samples_d20261017").
+			AddRow("metric_samples_w20261012").
+			AddRow("metric_samples_d20261019"))
+	mock.ExpectExec(`DROP TABLE IF EXISTS metric_samples_d20261016`).WillReturnResult(sqlmock.NewResult(0, 0))
+	dropped, err := h.DropExpired(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metric_samples_d20261016"}, dropped)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestHistoryCreatesMissingPartition(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	h := &HistoryStorage{DBStorage: &DBStorage{DB: db}, Partitioning: Partitioning{Period: "week"}}
+
+	noPartition := &pgconn.PgError{Code: pgerrcode.CheckViolation, Message: `no partition of relation "metric_samples" found for row`}
+	mock.ExpectExec(`INSERT INTO metric_samples`).WithArgs("load", "gauge", 0.5).WillReturnError(noPartition)
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS metric_samples_w`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO metric_samples`).WithArgs("load", "gauge", 0.5).WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(t, h.Update(context.Background(), "gauge", "load", 0.5))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// needs a disposable database, see TestPostgres in internal/schema
+func TestHistoryRange(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	h, err := ConnectHistory(dsn, PoolConfig{}, Partitioning{Period: "day", Ahead: 1})
+	require.NoError(t, err)
+	defer h.Close()
+	ctx := context.Background()
+	id := fmt.Sprintf("history_%d", os.Getpid())
+	defer h.ExecContext(ctx, `DELETE FROM metrics WHERE id = $1;`, id)
+	defer h.ExecContext(ctx, `DELETE FROM metric_samples WHERE id = $1;`, id)
+
+	from := time.Now().Add(-time.Minute)
+	for i := int64(1); i <= 3; i++ {
+		require.NoError(t, h.Update(ctx, "counter", id, i))
+	}
+	samples, err := h.Range(ctx, "counter", id, from, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, samples, 3)
+	assert.Equal(t, int64(6), *samples[2].Delta, "samples hold the running total")
+
+	current, err := h.Return(ctx, "counter", id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *current.Delta)
+}
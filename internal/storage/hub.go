@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+)
+
+// size of per-subscriber buffer, subscribers lagging behind more than that are dropped
+const subscriberBuffer = 64
+
+// Subscription delivers metric updates matching its filter.
+// C is closed when the subscriber is dropped or unsubscribed
+type Subscription struct {
+	C      chan collector.Metric
+	prefix string
+	mtype  string
+}
+
+func (s *Subscription) matches(m collector.Metric) bool {
+	if s.mtype != "" && s.mtype != m.MType {
+		return false
+	}
+	return strings.HasPrefix(m.ID, s.prefix)
+}
+
+// Hub is a fan-out pub/sub of metric updates
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	buffer int
+}
+
+// NewHub creates a hub, buffer <= 0 means the default subscriber buffer
+func NewHub(buffer int) *Hub {
+	if buffer <= 0 {
+		buffer = subscriberBuffer
+	}
+	return &Hub{
+		subs:   make(map[*Subscription]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Subscribe to updates of series with the given name prefix and type,
+// empty values match everything
+func (h *Hub) Subscribe(prefix, mtype string) *Subscription {
+	s := &Subscription{
+		C:      make(chan collector.Metric, h.buffer),
+		prefix: prefix,
+		mtype:  mtype,
+	}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// Publish never blocks: a subscriber with a full buffer is dropped.
+// Publishing to a nil hub does nothing
+func (h *Hub) Publish(metrics ...collector.Metric) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		for _, m := range metrics {
+			if !s.matches(m) {
+				continue
+			}
+			select {
+			case s.C <- m:
+			default:
+				h.remove(s)
+			}
+			if _, ok := h.subs[s]; !ok {
+				break
+			}
+		}
+	}
+}
+
+// Subscribers returns number of active subscriptions
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+func (h *Hub) remove(s *Subscription) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	close(s.C)
+}
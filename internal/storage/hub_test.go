@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub(2)
+	all := h.Subscribe("", "")
+	heap := h.Subscribe("Heap", "gauge")
+	counters := h.Subscribe("", "counter")
+
+	v := 1.0
+	d := int64(1)
+	h.Publish(
+		collector.Metric{ID: "HeapAlloc", MType: "gauge", Value: &v},
+		collector.Metric{ID: "PollCount", MType: "counter", Delta: &d},
+	)
+
+	assert.Len(t, all.C, 2)
+	assert.Len(t, heap.C, 1)
+	assert.Len(t, counters.C, 1)
+	assert.Equal(t, "HeapAlloc", (<-heap.C).ID)
+
+	// "all" has a full buffer and gets dropped instead of blocking
+	h.Publish(collector.Metric{ID: "Alloc", MType: "gauge", Value: &v})
+	assert.Equal(t, 2, h.Subscribers())
+	<-all.C
+	<-all.C
+	_, ok := <-all.C
+	assert.False(t, ok)
+
+	h.Unsubscribe(counters)
+	h.Unsubscribe(heap)
+	assert.Equal(t, 0, h.Subscribers())
+}
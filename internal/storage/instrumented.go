@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+)
+
+// InstrumentedStorage records latency and errors of every operation
+// under _server.storage.<backend>.<op>
+type InstrumentedStorage struct {
+	Database
+	backend string
+}
+
+func Instrument(db Database, backend string) *InstrumentedStorage {
+	return &InstrumentedStorage{Database: db, backend: backend}
+}
+
+func (s *InstrumentedStorage) Unwrap() Database {
+	return s.Database
+}
+
+func (s *InstrumentedStorage) observe(ctx context.Context, op string, start time.Time, err error) {
+	stats := selfstats.FromContext(ctx)
+	name := selfstats.Name("storage", s.backend, op)
+	stats.Observe(name+".latency", time.Since(start))
+	if err != nil {
+		stats.Inc(name+".errors", 1)
+	}
+}
+
+func (s *InstrumentedStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	start := time.Now()
+	err := s.Database.Update(ctx, mtype, id, value)
+	s.observe(ctx, "update", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	start := time.Now()
+	err := s.Database.UpdateBatch(ctx, metrics)
+	s.observe(ctx, "update_batch", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	start := time.Now()
+	m, err := s.Database.Return(ctx, mtype, id)
+	s.observe(ctx, "return", start, err)
+	return m, err
+}
+
+// Unwrap strips decorators and returns the underlying backend
+func Unwrap(db Database) Database {
+	for {
+		w, ok := db.(interface{ Unwrap() Database })
+		if !ok {
+			return db
+		}
+		db = w.Unwrap()
+	}
+}
+
+// As returns the outermost layer of db that is a T, decorators included
+func As[T any](db Database) (T, bool) {
+	for {
+		if t, ok := db.(T); ok {
+			return t, true
+		}
+		w, ok := db.(interface{ Unwrap() Database })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		db = w.Unwrap()
+	}
+}
@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// file inside the kv directory
+const kvFile = "metrics.db"
+
+var (
+	currentBucket = []byte("current")
+	samplesBucket = []byte("samples")
+)
+
+// KVStorage keeps metrics in an embedded bbolt file. every update is
+// committed and fsynced before it returns, concurrent updates share a commit.
+//
+// current holds "type/id" -> 8 byte value, samples holds
+// "type/id" 0x00 unix nanos seq -> 8 byte value, so one series is a contiguous key range
+type KVStorage struct {
+	db        *bolt.DB
+	history   bool
+	Events    *Hub          // optional, receives every change
+	Retention time.Duration // samples older than this are pruned by Maintain, 0 keeps all
+}
+
+// OpenKV opens or creates the store in dir, history keeps a sample of every update
+func OpenKV(dir string, history bool) (*KVStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// another process holding the file fails fast instead of hanging
+	db, err := bolt.Open(filepath.Join(dir, kvFile), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening kv storage: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{currentBucket, samplesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &KVStorage{db: db, history: history}, nil
+}
+
+func (s *KVStorage) Close() error {
+	return s.db.Close()
+}
+
+func currentKey(mtype, id string) []byte {
+	return []byte(mtype + "/" + id)
+}
+
+// samples of one series, the 0x00 keeps "a" from matching "ab"
+func seriesPrefix(mtype, id string) []byte {
+	return append(currentKey(mtype, id), 0)
+}
+
+func sampleKey(prefix []byte, t time.Time, seq uint64) []byte {
+	if t.Before(time.Unix(0, 0)) {
+		t = time.Unix(0, 0)
+	}
+	key := make([]byte, len(prefix), len(prefix)+16)
+	copy(key, prefix)
+	key = binary.BigEndian.AppendUint64(key, uint64(t.UnixNano()))
+	return binary.BigEndian.AppendUint64(key, seq)
+}
+
+func encodeValue(metric collector.Metric) []byte {
+	if metric.MType == "gauge" {
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(*metric.Value))
+	}
+	return binary.BigEndian.AppendUint64(nil, uint64(*metric.Delta))
+}
+
+// metric from a current key and its value
+func decodeMetric(key, value []byte) (collector.Metric, error) {
+	mtype, id, ok := strings.Cut(string(key), "/")
+	if !ok || len(value) != 8 {
+		return collector.Metric{}, fmt.Errorf("malformed kv entry %q", key)
+	}
+	return kvMetric(mtype, id, value)
+}
+
+func kvMetric(mtype, id string, value []byte) (collector.Metric, error) {
+	bits := binary.BigEndian.Uint64(value)
+	switch mtype {
+	case "gauge":
+		v := math.Float64frombits(bits)
+		return collector.Metric{ID: id, MType: mtype, Value: &v}, nil
+	case "counter":
+		d := int64(bits)
+		return collector.Metric{ID: id, MType: mtype, Delta: &d}, nil
+	}
+	return collector.Metric{}, fmt.Errorf("unknown metric type: %s", mtype)
+}
+
+// writes one series inside tx and returns its new value, counters add to the stored delta
+func (s *KVStorage) put(tx *bolt.Tx, metric collector.Metric, now time.Time) (collector.Metric, error) {
+	current := tx.Bucket(currentBucket)
+	key := currentKey(metric.MType, metric.ID)
+	if metric.MType == "counter" {
+		total := *metric.Delta
+		if old := current.Get(key); len(old) == 8 {
+			total += int64(binary.BigEndian.Uint64(old))
+		}
+		metric = collector.Metric{ID: metric.ID, MType: metric.MType, Delta: &total}
+	}
+	value := encodeValue(metric)
+	if err := current.Put(key, value); err != nil {
+		return metric, err
+	}
+	if !s.history {
+		return metric, nil
+	}
+	samples := tx.Bucket(samplesBucket)
+	seq, err := samples.NextSequence()
+	if err != nil {
+		return metric, err
+	}
+	return metric, samples.Put(sampleKey(seriesPrefix(metric.MType, metric.ID), now, seq), value)
+}
+
+func (s *KVStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	metric := collector.Metric{ID: id, MType: mtype}
+	switch mtype {
+	case "gauge":
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("type assertion error while updating kv storage")
+		}
+		metric.Value = &v
+	case "counter":
+		v, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("type assertion error while updating kv storage")
+		}
+		metric.Delta = &v
+	default:
+		return fmt.Errorf("unknown metric type: %s", mtype)
+	}
+
+	var changed collector.Metric
+	// Batch may run the function again, it only depends on tx
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		var err error
+		changed, err = s.put(tx, metric, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(changed)
+	return nil
+}
+
+// UpdateBatch commits the whole batch at once
+func (s *KVStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	merged, err := mergeBatch(metrics)
+	if err != nil {
+		return err
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	var changed collector.Metrics
+	err = s.db.Batch(func(tx *bolt.Tx) error {
+		changed = changed[:0]
+		now := time.Now()
+		for _, metric := range merged {
+			m, err := s.put(tx, metric, now)
+			if err != nil {
+				return err
+			}
+			changed = append(changed, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(changed...)
+	return nil
+}
+
+func (s *KVStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	var metric collector.Metric
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(currentBucket).Get(currentKey(mtype, id))
+		if value == nil {
+			return fmt.Errorf("no such %s metric", mtype)
+		}
+		var err error
+		metric, err = kvMetric(mtype, id, value)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &metric, nil
+}
+
+// List returns series of mtype whose id starts with prefix, sorted by id
+func (s *KVStorage) List(ctx context.Context, mtype string, prefix string) (collector.Metrics, error) {
+	var metrics collector.Metrics
+	err := s.db.View(func(tx *bolt.Tx) error {
+		start := currentKey(mtype, prefix)
+		c := tx.Bucket(currentBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, start); k, v = c.Next() {
+			metric, err := decodeMetric(k, v)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+		return nil
+	})
+	return metrics, err
+}
+
+// Range reads samples of one series, only keys inside [from, to) are visited
+func (s *KVStorage) Range(ctx context.Context, mtype string, id string, from, to time.Time) ([]Sample, error) {
+	if !s.history {
+		return nil, ErrHistoryUnsupported
+	}
+	prefix := seriesPrefix(mtype, id)
+	end := sampleKey(prefix, to, 0)
+	var samples []Sample
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(samplesBucket).Cursor()
+		for k, v := c.Seek(sampleKey(prefix, from, 0)); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			if len(k) != len(prefix)+16 || len(v) != 8 {
+				return fmt.Errorf("malformed kv sample %q", k)
+			}
+			metric, err := kvMetric(mtype, id, v)
+			if err != nil {
+				return err
+			}
+			ts := int64(binary.BigEndian.Uint64(k[len(prefix):]))
+			samples = append(samples, Sample{Time: time.Unix(0, ts).UTC(), Value: metric.Value, Delta: metric.Delta})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// Prune deletes samples older than before and returns how many
+func (s *KVStorage) Prune(ctx context.Context, before time.Time) (int, error) {
+	// collected first, deleting under a cursor skips keys
+	var expired [][]byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(samplesBucket).ForEach(func(k, _ []byte) error {
+			if len(k) < 16 {
+				return nil
+			}
+			ts := int64(binary.BigEndian.Uint64(k[len(k)-16:]))
+			if ts < before.UnixNano() {
+				expired = append(expired, bytes.Clone(k))
+			}
+			return ctx.Err()
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// small transactions keep writers from waiting behind a long prune
+	const chunk = 10000
+	for i := 0; i < len(expired); i += chunk {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			samples := tx.Bucket(samplesBucket)
+			for _, k := range expired[i:min(i+chunk, len(expired))] {
+				if err := samples.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// Maintain prunes samples past the retention every interval until ctx is done
+func (s *KVStorage) Maintain(ctx context.Context, interval time.Duration) {
+	if !s.history || s.Retention <= 0 {
+		return
+	}
+	log := logger.FromContext(ctx)
+	for {
+		pruned, err := s.Prune(ctx, time.Now().Add(-s.Retention))
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Error("error while pruning kv samples", zap.Error(err))
+		}
+		if pruned > 0 {
+			log.Info("pruned kv samples", zap.Int("samples", pruned))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Export reads every series in one read transaction, which sees a consistent view
+func (s *KVStorage) Export(ctx context.Context) (collector.Metrics, error) {
+	var metrics collector.Metrics
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(currentBucket).ForEach(func(k, v []byte) error {
+			metric, err := decodeMetric(k, v)
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// Import sets series in one transaction, samples are left as they are
+func (s *KVStorage) Import(ctx context.Context, metrics collector.Metrics, replace bool) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if replace {
+			if err := tx.DeleteBucket(currentBucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(currentBucket); err != nil {
+				return err
+			}
+		}
+		current := tx.Bucket(currentBucket)
+		for _, metric := range metrics {
+			if err := current.Put(currentKey(metric.MType, metric.ID), encodeValue(metric)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(metrics...)
+	return nil
+}
+
+// Take removes exported current values in one transaction, samples are left to retention
+func (s *KVStorage) Take(ctx context.Context, metrics collector.Metrics) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		current := tx.Bucket(currentBucket)
+		for _, metric := range metrics {
+			key := currentKey(metric.MType, metric.ID)
+			value := current.Get(key)
+			if value == nil {
+				continue
+			}
+			stored, err := decodeMetric(key, value)
+			if err != nil {
+				return err
+			}
+			switch metric.MType {
+			case "gauge":
+				if *stored.Value != *metric.Value {
+					continue
+				}
+			case "counter":
+				if left := *stored.Delta - *metric.Delta; left != 0 {
+					stored.Delta = &left
+					if err := current.Put(key, encodeValue(stored)); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if err := current.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStorage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	s, err := OpenKV(dir, true)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Update(ctx, "gauge", "load", 0.0))
+	require.NoError(t, s.Update(ctx, "gauge", "load_avg", 1.5))
+	require.NoError(t, s.Update(ctx, "gauge", "lo", 2.5))
+	one, two := int64(1), int64(2)
+	require.NoError(t, s.UpdateBatch(ctx, collector.Metrics{
+		{ID: "requests", MType: "counter", Delta: &one},
+		{ID: "requests", MType: "counter", Delta: &two},
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Update(ctx, "counter", "requests", int64(1)))
+		}()
+	}
+	wg.Wait()
+
+	m, err := s.Return(ctx, "counter", "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(23), *m.Delta)
+	m, err = s.Return(ctx, "gauge", "load")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, *m.Value, "zero gauge is stored")
+	_, err = s.Return(ctx, "gauge", "missing")
+	assert.Error(t, err)
+
+	listed, err := s.List(ctx, "gauge", "load")
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, "load", listed[0].ID)
+	assert.Equal(t, "load_avg", listed[1].ID)
+
+	// durable across reopen
+	require.NoError(t, s.Close())
+	s, err = OpenKV(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+	exported, err := s.Export(ctx)
+	require.NoError(t, err)
+	assert.Len(t, exported, 4)
+
+	// one batch sample plus one per concurrent update, each holding the running total
+	samples, err := s.Range(ctx, "counter", "requests", time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, samples, 21)
+	assert.Equal(t, int64(3), *samples[0].Delta)
+	assert.Equal(t, int64(23), *samples[20].Delta)
+
+	// "load" does not see samples of "load_avg"
+	samples, err = s.Range(ctx, "gauge", "load", time.Time{}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+
+	samples, err = s.Range(ctx, "counter", "requests", time.Now().Add(time.Minute), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	pruned, err := s.Prune(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 24, pruned)
+	samples, err = s.Range(ctx, "counter", "requests", time.Time{}, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+	m, err = s.Return(ctx, "counter", "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(23), *m.Delta, "pruning keeps current values")
+
+	// taking keeps what was written since the export
+	exportedDelta, left, stale, zero := int64(20), int64(3), 1.0, 0.0
+	require.NoError(t, s.Take(ctx, collector.Metrics{
+		{ID: "requests", MType: "counter", Delta: &exportedDelta},
+		{ID: "load", MType: "gauge", Value: &stale},
+		{ID: "load", MType: "counter", Delta: &exportedDelta},
+	}))
+	m, err = s.Return(ctx, "counter", "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), *m.Delta)
+	_, err = s.Return(ctx, "gauge", "load")
+	assert.NoError(t, err, "gauge set since the export is kept")
+
+	require.NoError(t, s.Take(ctx, collector.Metrics{
+		{ID: "requests", MType: "counter", Delta: &left},
+		{ID: "load", MType: "gauge", Value: &zero},
+	}))
+	_, err = s.Return(ctx, "counter", "requests")
+	assert.Error(t, err)
+	_, err = s.Return(ctx, "gauge", "load")
+	assert.Error(t, err)
+}
+
+func TestKVWithoutHistory(t *testing.T) {
+	s, err := OpenKV(t.TempDir(), false)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Update(context.Background(), "gauge", "load", 1.0))
+	_, err = s.Range(context.Background(), "gauge", "load", time.Time{}, time.Now())
+	assert.ErrorIs(t, err, ErrHistoryUnsupported)
+}
+
+func TestDetermineStorage(t *testing.T) {
+	tests := []struct {
+		url     string
+		scheme  string
+		target  string
+		backend any
+	}{
+		{url: "memory", scheme: "memory", backend: &MemStorage{}},
+		{url: "kv:" + t.TempDir(), scheme: "kv", backend: &KVStorage{}},
+		{url: "postgres://u:p@localhost/metrics", scheme: "postgres", target: "postgres://u:p@localhost/metrics"},
+		{url: "postgres:host=localhost user=u", scheme: "postgres", target: "host=localhost user=u"},
+		{url: "kv:///var/lib/metrics", scheme: "kv", target: "/var/lib/metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			scheme, target := ParseStorage(tt.url)
+			assert.Equal(t, tt.scheme, scheme)
+			if tt.target != "" {
+				assert.Equal(t, tt.target, target)
+			}
+			if tt.backend == nil {
+				return
+			}
+			db, err := DetermineStorage(tt.url, Options{})
+			require.NoError(t, err)
+			assert.IsType(t, tt.backend, Unwrap(db))
+			if kv, ok := Unwrap(db).(*KVStorage); ok {
+				kv.Close()
+			}
+		})
+	}
+
+	_, err := DetermineStorage("redis://localhost", Options{})
+	assert.ErrorContains(t, err, "unknown storage")
+	_, err = DetermineStorage("kv:", Options{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"go.uber.org/zap"
+)
+
+// LoggedStorage logs every operation with its duration and error at debug level
+type LoggedStorage struct {
+	Database
+	log *zap.Logger
+}
+
+func NewLoggedStorage(db Database, log *zap.Logger) *LoggedStorage {
+	return &LoggedStorage{Database: db, log: log}
+}
+
+func (s *LoggedStorage) Unwrap() Database {
+	return s.Database
+}
+
+// fields are only built when debug is enabled
+func (s *LoggedStorage) write(op string, start time.Time, err error, fields ...zap.Field) {
+	ce := s.log.Check(zap.DebugLevel, "storage "+op)
+	if ce == nil {
+		return
+	}
+	fields = append(fields, zap.Duration("took", time.Since(start)))
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	ce.Write(fields...)
+}
+
+func (s *LoggedStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	start := time.Now()
+	err := s.Database.Update(ctx, mtype, id, value)
+	s.write("update", start, err, zap.String("type", mtype), zap.String("id", id), zap.Any("value", value))
+	return err
+}
+
+func (s *LoggedStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	start := time.Now()
+	err := s.Database.UpdateBatch(ctx, metrics)
+	s.write("update_batch", start, err, zap.Int("size", len(metrics)))
+	return err
+}
+
+func (s *LoggedStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	start := time.Now()
+	m, err := s.Database.Return(ctx, mtype, id)
+	s.write("return", start, err, zap.String("type", mtype), zap.String("id", id))
+	return m, err
+}
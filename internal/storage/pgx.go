@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/paranoiachains/metrics/internal/collector"
+)
+
+// batches at least this large are loaded with COPY, smaller ones are pipelined with pgx.Batch
+const copyThreshold = 256
+
+// merges the COPY staging table in one statement, ON CONFLICT takes row locks in id order
+const stagingMergeQuery = `
+	INSERT INTO metrics (id, mtype, value, delta)
+	SELECT id, mtype, value, delta FROM metrics_staging ORDER BY id
+	ON CONFLICT (id) DO UPDATE
+		SET value = EXCLUDED.value,
+			delta = CASE WHEN EXCLUDED.mtype = 'counter'
+				THEN COALESCE(metrics.delta, 0) + EXCLUDED.delta END
+	RETURNING id, mtype, value, delta;`
+
+// PgxStorage is the postgres backend on a native pgx pool,
+// it writes batches with COPY instead of one statement per metric
+type PgxStorage struct {
+	Pool       *pgxpool.Pool
+	Events     *Hub        // optional, receives every change
+	Resilience *Resilience // nil retries with the default policy and never fails fast
+}
+
+// NewPgxPoolConfig parses dsn and applies pool, pool_* dsn parameters take precedence
+func NewPgxPoolConfig(dsn string, pool PoolConfig) (*pgxpool.Config, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool = pool.withDefaults()
+	if !strings.Contains(dsn, "pool_max_conns") {
+		cfg.MaxConns = int32(pool.MaxOpenConns)
+	}
+	if !strings.Contains(dsn, "pool_min_conns") {
+		cfg.MinConns = 1
+	}
+	if !strings.Contains(dsn, "pool_max_conn_lifetime") {
+		cfg.MaxConnLifetime = pool.ConnMaxLifetime
+	}
+	if !strings.Contains(dsn, "pool_max_conn_idle_time") {
+		cfg.MaxConnIdleTime = pool.ConnMaxIdleTime
+	}
+	if !strings.Contains(dsn, "pool_health_check_period") {
+		cfg.HealthCheckPeriod = 30 * time.Second
+	}
+	applyStatementTimeout(cfg.ConnConfig, pool.StatementTimeout)
+	return cfg, nil
+}
+
+// ConnectPgx opens a pool, pings it and applies schema migrations
+func ConnectPgx(dsn string, pool PoolConfig) (*PgxStorage, error) {
+	return connectPgx(context.Background(), dsn, pool)
+}
+
+// connectPgx is ConnectPgx reporting through the logger and stats of parent
+func connectPgx(parent context.Context, dsn string, pool PoolConfig) (*PgxStorage, error) {
+	cfg, err := NewPgxPoolConfig(dsn, pool)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(parent, 2*time.Second)
+	defer cancel()
+	conns, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := conns.Ping(ctx); err != nil {
+		conns.Close()
+		return nil, err
+	}
+
+	// migrations run through database/sql on top of the same pool
+	migrateCtx, cancelMigrate := context.WithTimeout(parent, migrateTimeout)
+	defer cancelMigrate()
+	resilience := pool.withDefaults().resilience()
+	db := stdlib.OpenDBFromPool(conns)
+	err = DBStorage{DB: db, Resilience: resilience}.Migrate(migrateCtx)
+	db.Close()
+	if err != nil {
+		conns.Close()
+		return nil, err
+	}
+	return &PgxStorage{Pool: conns, Resilience: resilience}, nil
+}
+
+// PoolStats reports the pgx pool and breaker state
+func (s *PgxStorage) PoolStats() PoolStats {
+	st := s.Pool.Stat()
+	stats := PoolStats{
+		Driver:         "pgx",
+		MaxOpen:        int(st.MaxConns()),
+		Open:           int(st.TotalConns()),
+		InUse:          int(st.AcquiredConns()),
+		Idle:           int(st.IdleConns()),
+		WaitCount:      st.EmptyAcquireCount(),
+		WaitDurationMs: st.AcquireDuration().Milliseconds(),
+		Closed:         st.MaxIdleDestroyCount() + st.MaxLifetimeDestroyCount(),
+	}
+	if s.Resilience != nil {
+		stats.Breaker = s.Resilience.Breaker.State()
+	}
+	return stats
+}
+
+func (s *PgxStorage) PingContext(ctx context.Context) error {
+	return s.Pool.Ping(ctx)
+}
+
+func (s *PgxStorage) Close() error {
+	s.Pool.Close()
+	return nil
+}
+
+func (s *PgxStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	switch mtype {
+	case "gauge":
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("type assertion error while updating database")
+		}
+		err := withRetry(ctx, s.Resilience, func() error {
+			_, err := s.Pool.Exec(ctx, gaugeUpsertQuery, id, mtype, v)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		s.Events.Publish(collector.Metric{ID: id, MType: mtype, Value: &v})
+		return nil
+
+	case "counter":
+		v, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("type assertion error while updating database")
+		}
+		var total int64
+		err := withRetry(ctx, s.Resilience, func() error {
+			return s.Pool.QueryRow(ctx, counterUpsertQuery, id, mtype, v).Scan(&total)
+		})
+		if err != nil {
+			return err
+		}
+		s.Events.Publish(collector.Metric{ID: id, MType: mtype, Delta: &total})
+		return nil
+	default:
+		return fmt.Errorf("unknown metric type: %s", mtype)
+	}
+}
+
+// UpdateBatch writes the whole batch in one transaction and one or two round trips
+func (s *PgxStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	merged, err := mergeBatch(metrics)
+	if err != nil {
+		return err
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	write := s.pipeline
+	if len(merged) >= copyThreshold && uniqueIDs(merged) {
+		write = s.copyMerge
+	}
+	var changed collector.Metrics
+	err = withRetry(ctx, s.Resilience, func() error {
+		changed, err = write(ctx, merged)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(changed...)
+	return nil
+}
+
+// queues every upsert and sends them together
+func (s *PgxStorage) pipeline(ctx context.Context, metrics collector.Metrics) (collector.Metrics, error) {
+	changed := make(collector.Metrics, 0, len(metrics))
+	err := pgx.BeginFunc(ctx, s.Pool, func(tx pgx.Tx) error {
+		batch := &pgx.Batch{}
+		for _, metric := range metrics {
+			switch metric.MType {
+			case "gauge":
+				batch.Queue(gaugeUpsertQuery, metric.ID, metric.MType, *metric.Value)
+			case "counter":
+				batch.Queue(counterUpsertQuery, metric.ID, metric.MType, *metric.Delta)
+			}
+		}
+
+		results := tx.SendBatch(ctx, batch)
+		for _, metric := range metrics {
+			switch metric.MType {
+			case "gauge":
+				if _, err := results.Exec(); err != nil {
+					results.Close()
+					return err
+				}
+				changed = append(changed, metric)
+			case "counter":
+				var total int64
+				if err := results.QueryRow().Scan(&total); err != nil {
+					results.Close()
+					return err
+				}
+				changed = append(changed, collector.Metric{ID: metric.ID, MType: metric.MType, Delta: &total})
+			}
+		}
+		return results.Close()
+	})
+	return changed, err
+}
+
+// copies the batch into a temporary table and merges it with a single statement
+func (s *PgxStorage) copyMerge(ctx context.Context, metrics collector.Metrics) (collector.Metrics, error) {
+	changed := make(collector.Metrics, 0, len(metrics))
+	err := pgx.BeginFunc(ctx, s.Pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+	CREATE TEMPORARY TABLE IF NOT EXISTS metrics_staging (
+    id VARCHAR(255) NOT NULL,
+    mtype VARCHAR(50) NOT NULL,
+    value DOUBLE PRECISION,
+    delta BIGINT
+) ON COMMIT DELETE ROWS;`)
+		if err != nil {
+			return err
+		}
+
+		rows := pgx.CopyFromSlice(len(metrics), func(i int) ([]any, error) {
+			m := metrics[i]
+			return []any{m.ID, m.MType, m.Value, m.Delta}, nil
+		})
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"metrics_staging"}, []string{"id", "mtype", "value", "delta"}, rows); err != nil {
+			return err
+		}
+
+		result, err := tx.Query(ctx, stagingMergeQuery)
+		if err != nil {
+			return err
+		}
+		for result.Next() {
+			var metric collector.Metric
+			if err := result.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta); err != nil {
+				result.Close()
+				return err
+			}
+			changed = append(changed, metric)
+		}
+		return result.Err()
+	})
+	return changed, err
+}
+
+// ON CONFLICT cannot touch a row twice, so a batch with the same id
+// as both gauge and counter is not merged from the staging table
+func uniqueIDs(metrics collector.Metrics) bool {
+	seen := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		if _, ok := seen[metric.ID]; ok {
+			return false
+		}
+		seen[metric.ID] = struct{}{}
+	}
+	return true
+}
+
+func (s *PgxStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	selectQuery := `
+	SELECT id, mtype, value, delta
+	FROM metrics
+	WHERE id=$1 AND mtype=$2;`
+
+	var metric collector.Metric
+	err := withRetry(ctx, s.Resilience, func() error {
+		return s.Pool.QueryRow(ctx, selectQuery, id, mtype).Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("no such %s metric", mtype)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &metric, nil
+}
+
+// Export reads every series in a single statement, which sees one snapshot of the table
+func (s *PgxStorage) Export(ctx context.Context) (collector.Metrics, error) {
+	var metrics collector.Metrics
+	err := withRetry(ctx, s.Resilience, func() error {
+		rows, err := s.Pool.Query(ctx, `SELECT id, mtype, value, delta FROM metrics ORDER BY id;`)
+		if err != nil {
+			return err
+		}
+		metrics, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (collector.Metric, error) {
+			var metric collector.Metric
+			err := row.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta)
+			return metric, err
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// Take removes exported values in one transaction
+func (s *PgxStorage) Take(ctx context.Context, metrics collector.Metrics) error {
+	args := newTakeArgs(metrics)
+	return withRetry(ctx, s.Resilience, func() error {
+		return pgx.BeginFunc(ctx, s.Pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, takeCountersQuery, args.counters, args.deltas); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, dropCountersQuery, args.counters); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, dropGaugesQuery, args.gauges, args.values)
+			return err
+		})
+	})
+}
+
+// Import sets series in one transaction using COPY
+func (s *PgxStorage) Import(ctx context.Context, metrics collector.Metrics, replace bool) error {
+	err := withRetry(ctx, s.Resilience, func() error {
+		return pgx.BeginFunc(ctx, s.Pool, func(tx pgx.Tx) error {
+			if replace {
+				if _, err := tx.Exec(ctx, `DELETE FROM metrics;`); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(ctx, `
+	CREATE TEMPORARY TABLE IF NOT EXISTS metrics_import (LIKE metrics INCLUDING DEFAULTS) ON COMMIT DROP;`)
+			if err != nil {
+				return err
+			}
+			rows := pgx.CopyFromSlice(len(metrics), func(i int) ([]any, error) {
+				m := metrics[i]
+				return []any{m.ID, m.MType, m.Value, m.Delta}, nil
+			})
+			if _, err := tx.CopyFrom(ctx, pgx.Identifier{"metrics_import"}, []string{"id", "mtype", "value", "delta"}, rows); err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `
+	INSERT INTO metrics (id, mtype, value, delta)
+	SELECT DISTINCT ON (id) id, mtype, value, delta FROM metrics_import ORDER BY id
+	ON CONFLICT (id) DO UPDATE
+		SET mtype = EXCLUDED.mtype, value = EXCLUDED.value, delta = EXCLUDED.delta;`)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(metrics...)
+	return nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPgxPoolConfig(t *testing.T) {
+	cfg, err := NewPgxPoolConfig("postgres://user@localhost/metrics", PoolConfig{})
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, cfg.MaxConns, int32(4))
+	assert.Equal(t, int32(1), cfg.MinConns)
+	assert.Equal(t, 5*time.Minute, cfg.MaxConnIdleTime)
+
+	// dsn parameters win over defaults
+	cfg, err = NewPgxPoolConfig("postgres://user@localhost/metrics?pool_max_conns=2&pool_min_conns=0", PoolConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), cfg.MaxConns)
+	assert.Equal(t, int32(0), cfg.MinConns)
+
+	_, err = NewPgxPoolConfig("postgres://user@localhost/metrics?pool_max_conns=many", PoolConfig{})
+	assert.Error(t, err)
+}
+
+func TestUniqueIDs(t *testing.T) {
+	one, half := int64(1), 0.5
+	assert.True(t, uniqueIDs(collector.Metrics{{ID: "a", MType: "counter", Delta: &one}, {ID: "b", MType: "gauge", Value: &half}}))
+	assert.False(t, uniqueIDs(collector.Metrics{{ID: "a", MType: "counter", Delta: &one}, {ID: "a", MType: "gauge", Value: &half}}))
+}
+
+func testBatch(n int, prefix string) collector.Metrics {
+	metrics := make(collector.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			delta := int64(i)
+			metrics = append(metrics, collector.Metric{ID: fmt.Sprintf("%s_c%d", prefix, i), MType: "counter", Delta: &delta})
+			continue
+		}
+		value := float64(i) / 2
+		metrics = append(metrics, collector.Metric{ID: fmt.Sprintf("%s_g%d", prefix, i), MType: "gauge", Value: &value})
+	}
+	return metrics
+}
+
+// needs a disposable database, see TestPostgres in internal/schema
+func TestPgxUpdateBatch(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	s, err := ConnectPgx(dsn, PoolConfig{})
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+	prefix := fmt.Sprintf("pgx_%d", os.Getpid())
+	defer s.Pool.Exec(ctx, `DELETE FROM metrics WHERE id LIKE $1;`, prefix+"%")
+
+	// below and above copyThreshold, counters add up across batches either way
+	for _, n := range []int{10, copyThreshold * 2} {
+		batch := testBatch(n, fmt.Sprintf("%s_%d", prefix, n))
+		require.NoError(t, s.UpdateBatch(ctx, batch))
+		require.NoError(t, s.UpdateBatch(ctx, batch))
+
+		counter, err := s.Return(ctx, "counter", batch[2].ID)
+		require.NoError(t, err)
+		assert.Equal(t, *batch[2].Delta*2, *counter.Delta)
+		gauge, err := s.Return(ctx, "gauge", batch[1].ID)
+		require.NoError(t, err)
+		assert.Equal(t, *batch[1].Value, *gauge.Value)
+	}
+}
+
+// go test -bench Postgres -run ^$ with TEST_DATABASE_DSN set
+func BenchmarkPostgresUpdateBatch(b *testing.B) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+	sqlDB, err := ConnectAndPing("pgx", dsn)
+	require.NoError(b, err)
+	defer sqlDB.Close()
+	pgxDB, err := ConnectPgx(dsn, PoolConfig{})
+	require.NoError(b, err)
+	defer pgxDB.Close()
+
+	backends := []struct {
+		name string
+		db   Database
+	}{
+		{"sql", sqlDB},
+		{"pgx", pgxDB},
+	}
+	for _, size := range []int{50, 5000} {
+		for _, backend := range backends {
+			b.Run(fmt.Sprintf("%s/%d", backend.name, size), func(b *testing.B) {
+				prefix := fmt.Sprintf("bench_%s_%d", backend.name, size)
+				defer pgxDB.Pool.Exec(ctx, `DELETE FROM metrics WHERE id LIKE $1;`, prefix+"%")
+				batch := testBatch(size, prefix)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := backend.db.UpdateBatch(ctx, batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "metrics/s")
+			})
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeBatch(t *testing.T) {
+	d := func(v int64) *int64 { return &v }
+	g := func(v float64) *float64 { return &v }
+
+	merged, err := mergeBatch(collector.Metrics{
+		{ID: "b", MType: "counter", Delta: d(1)},
+		{ID: "a", MType: "gauge", Value: g(1)},
+		{ID: "b", MType: "counter", Delta: d(2)},
+		{ID: "a", MType: "gauge", Value: g(3)},
+		{ID: "b", MType: "counter", Delta: d(4)},
+	})
+	require.NoError(t, err)
+	require.Len(t, merged, 2)
+	assert.Equal(t, "a", merged[0].ID)
+	assert.Equal(t, 3.0, *merged[0].Value)
+	assert.Equal(t, "b", merged[1].ID)
+	assert.Equal(t, int64(7), *merged[1].Delta)
+
+	_, err = mergeBatch(collector.Metrics{{ID: "x", MType: "counter"}})
+	assert.Error(t, err)
+}
+
+func TestDBCounterIsSingleUpsert(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	s := DBStorage{DB: db}
+
+	// no SELECT before the write
+	mock.ExpectQuery(`INSERT INTO metrics .* delta = COALESCE\(metrics.delta, 0\) \+ EXCLUDED.delta`).
+		WithArgs("PollCount", "counter", int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(12)))
+	require.NoError(t, s.Update(context.Background(), "counter", "PollCount", int64(5)))
+
+	// repeated ids are written once
+	d1, d2 := int64(1), int64(2)
+	mock.ExpectBegin()
+	mock.ExpectPrepare(`INSERT INTO metrics`)
+	counter := mock.ExpectPrepare(`INSERT INTO metrics .* RETURNING delta`)
+	counter.ExpectQuery().WithArgs("PollCount", "counter", int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(15)))
+	mock.ExpectCommit()
+	require.NoError(t, s.UpdateBatch(context.Background(), collector.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &d1},
+		{ID: "PollCount", MType: "counter", Delta: &d2},
+	}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// lets array arguments through like the pgx driver does
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	switch v.(type) {
+	case []string, []int64, []float64:
+		return v, nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+func TestDBTake(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
+	require.NoError(t, err)
+	defer db.Close()
+	s := DBStorage{DB: db}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE metrics m SET delta = m.delta - t.delta`).
+		WithArgs([]string{"requests"}, []int64{5}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM metrics\s+WHERE mtype = 'counter' AND delta = 0`).
+		WithArgs([]string{"requests"}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM metrics m\s+USING unnest`).
+		WithArgs([]string{"load"}, []float64{0.5}).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	v, d := 0.5, int64(5)
+	require.NoError(t, s.Take(context.Background(), collector.Metrics{
+		{ID: "load", MType: "gauge", Value: &v},
+		{ID: "requests", MType: "counter", Delta: &d},
+	}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// needs a disposable database, see TestPostgres in internal/schema
+func TestDBConcurrentCounterUpdates(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	s, err := ConnectAndPing("pgx", dsn)
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+	id := fmt.Sprintf("concurrent_%d", os.Getpid())
+	defer s.ExecContext(ctx, `DELETE FROM metrics WHERE id = $1;`, id)
+
+	const workers = 16
+	const updates = 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				if w%2 == 0 {
+					assert.NoError(t, s.Update(ctx, "counter", id, int64(1)))
+					continue
+				}
+				one := int64(1)
+				assert.NoError(t, s.UpdateBatch(ctx, collector.Metrics{{ID: id, MType: "counter", Delta: &one}}))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	m, err := s.Return(ctx, "counter", id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(workers*updates), *m.Delta)
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"go.uber.org/zap"
+)
+
+// Options are shared by every backend, each reads the fields it understands
+type Options struct {
+	Driver     string        // postgres client, pgx or sql
+	Pool       PoolConfig    // postgres pool
+	History    *Partitioning // keep samples, nil disables history
+	Cache      *CacheOptions // postgres read cache, nil disables it
+	Events     *Hub          // receives every change
+	Decorators []Decorator   // wrap the backend, first is outermost
+
+	Log   *zap.Logger         // nil logs through logger.Log
+	Stats *selfstats.Registry // nil records into selfstats.Default
+}
+
+// context carries the logger and stats to code that takes them from ctx
+func (o Options) context() context.Context {
+	ctx := logger.WithContext(context.Background(), logger.Or(o.Log))
+	return selfstats.WithContext(ctx, selfstats.Or(o.Stats))
+}
+
+// Opener opens a backend, target is the storage url without the scheme
+// except for postgres, which gets the whole dsn
+type Opener func(target string, opts Options) (Database, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]Opener{}
+)
+
+// RegisterBackend makes a backend available under scheme, e.g. "kv" for kv:/var/lib/metrics
+func RegisterBackend(scheme string, open Opener) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[scheme] = open
+}
+
+// Backends lists registered schemes
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	schemes := make([]string, 0, len(backends))
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// ParseStorage splits a storage url into scheme and target. "memory", "kv:/var/lib/metrics",
+// "postgres://..." and "postgres:host=... user=..." are all valid
+func ParseStorage(storageURL string) (string, string) {
+	scheme, target, _ := strings.Cut(storageURL, ":")
+	switch scheme {
+	case "postgres", "postgresql":
+		if strings.HasPrefix(target, "//") {
+			return "postgres", storageURL
+		}
+		return "postgres", target
+	}
+	return scheme, strings.TrimPrefix(target, "//")
+}
+
+// DetermineStorage opens the backend of storageURL wrapped by opts.Decorators
+func DetermineStorage(storageURL string, opts Options) (Database, error) {
+	scheme, target := ParseStorage(storageURL)
+	backendsMu.RLock()
+	open, ok := backends[scheme]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage %q, want one of %s", scheme, strings.Join(Backends(), ", "))
+	}
+	db, err := open(target, opts)
+	if err != nil {
+		return nil, err
+	}
+	return Chain(db, opts.Decorators...), nil
+}
+
+func init() {
+	RegisterBackend("memory", openMemory)
+	RegisterBackend("postgres", openPostgres)
+	RegisterBackend("kv", openKV)
+}
+
+func openMemory(_ string, opts Options) (Database, error) {
+	mem := NewMemStorage()
+	mem.Events = opts.Events
+	mem.Log = opts.Log
+	mem.Stats = opts.Stats
+	logger.Or(opts.Log).Info("using memory storage")
+	return mem, nil
+}
+
+// history always uses the sql client
+func openPostgres(dsn string, opts Options) (Database, error) {
+	db, err := connectPostgres(dsn, opts)
+	if err != nil || opts.Cache == nil {
+		return db, err
+	}
+	logger.Or(opts.Log).Info("caching postgres reads", zap.Int("size", opts.Cache.Size), zap.Duration("ttl", opts.Cache.TTL))
+	return NewCachedStorage(db, dsn, *opts.Cache), nil
+}
+
+func connectPostgres(dsn string, opts Options) (Database, error) {
+	log := logger.Or(opts.Log)
+	switch {
+	case opts.History != nil:
+		db, err := connectHistory(opts.context(), dsn, opts.Pool, *opts.History)
+		if err != nil {
+			return nil, err
+		}
+		db.Events = opts.Events
+		log.Info("using postgres storage", zap.String("client", "sql"), zap.Bool("history", true))
+		return db, nil
+	case opts.Driver == "sql":
+		db, err := connect(opts.context(), "pgx", dsn, opts.Pool)
+		if err != nil {
+			return nil, err
+		}
+		db.Events = opts.Events
+		log.Info("using postgres storage", zap.String("client", "sql"))
+		return db, nil
+	default:
+		db, err := connectPgx(opts.context(), dsn, opts.Pool)
+		if err != nil {
+			return nil, err
+		}
+		db.Events = opts.Events
+		log.Info("using postgres storage", zap.String("client", "pgx"))
+		return db, nil
+	}
+}
+
+func openKV(dir string, opts Options) (Database, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("kv storage needs a directory, e.g. kv:/var/lib/metrics")
+	}
+	kv, err := OpenKV(dir, opts.History != nil)
+	if err != nil {
+		return nil, err
+	}
+	kv.Events = opts.Events
+	if opts.History != nil {
+		kv.Retention = opts.History.Retention
+	}
+	logger.Or(opts.Log).Info("using kv storage", zap.String("dir", dir), zap.Bool("history", opts.History != nil))
+	return kv, nil
+}
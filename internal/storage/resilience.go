@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"go.uber.org/zap"
+)
+
+// ErrCircuitOpen is returned without touching postgres while the breaker is open
+var ErrCircuitOpen = errors.New("postgres unavailable, circuit breaker is open")
+
+// PoolConfig tunes the connection pool and failure handling, zero fields pick defaults
+type PoolConfig struct {
+	MaxOpenConns     int
+	MaxIdleConns     int // database/sql only, pgxpool keeps idle connections up to MaxOpenConns
+	ConnMaxLifetime  time.Duration
+	ConnMaxIdleTime  time.Duration
+	StatementTimeout time.Duration // set as statement_timeout of every session
+	Retry            RetryPolicy
+	BreakerThreshold int // consecutive connection failures that open the breaker, 0 disables it
+	BreakerCooldown  time.Duration
+}
+
+// DefaultPoolConfig is used by ConnectAndPing and ConnectPgx
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxOpenConns:     max(4, runtime.NumCPU()*2),
+		MaxIdleConns:     max(4, runtime.NumCPU()*2),
+		ConnMaxLifetime:  30 * time.Minute,
+		ConnMaxIdleTime:  5 * time.Minute,
+		Retry:            DefaultRetryPolicy(),
+		BreakerThreshold: 5,
+		BreakerCooldown:  10 * time.Second,
+	}
+}
+
+// fills zero fields from defaults
+func (c PoolConfig) withDefaults() PoolConfig {
+	def := DefaultPoolConfig()
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = def.MaxOpenConns
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = min(def.MaxIdleConns, c.MaxOpenConns)
+	}
+	if c.ConnMaxLifetime == 0 {
+		c.ConnMaxLifetime = def.ConnMaxLifetime
+	}
+	if c.ConnMaxIdleTime == 0 {
+		c.ConnMaxIdleTime = def.ConnMaxIdleTime
+	}
+	if c.Retry == (RetryPolicy{}) {
+		c.Retry = def.Retry
+	}
+	if c.BreakerCooldown == 0 {
+		c.BreakerCooldown = def.BreakerCooldown
+	}
+	return c
+}
+
+func (c PoolConfig) resilience() *Resilience {
+	r := &Resilience{Retry: c.Retry}
+	if c.BreakerThreshold > 0 {
+		r.Breaker = NewBreaker(c.BreakerThreshold, c.BreakerCooldown)
+	}
+	return r
+}
+
+// sets statement_timeout as a session parameter, works for both drivers
+func applyStatementTimeout(cfg *pgx.ConnConfig, timeout time.Duration) {
+	if timeout > 0 {
+		cfg.RuntimeParams["statement_timeout"] = fmt.Sprint(timeout.Milliseconds())
+	}
+}
+
+// registers a parsed config with the pgx stdlib driver, returns the name to pass to sql.Open
+func registerConnConfig(dsn string, pool PoolConfig) (string, error) {
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return "", err
+	}
+	applyStatementTimeout(cfg, pool.StatementTimeout)
+	return stdlib.RegisterConnConfig(cfg), nil
+}
+
+// PoolStats is a snapshot of the connection pool
+type PoolStats struct {
+	Driver         string `json:"driver"`
+	MaxOpen        int    `json:"max_open"`
+	Open           int    `json:"open"`
+	InUse          int    `json:"in_use"`
+	Idle           int    `json:"idle"`
+	WaitCount      int64  `json:"wait_count"` // acquires that had to wait for a connection
+	WaitDurationMs int64  `json:"wait_duration_ms"`
+	Closed         int64  `json:"closed"` // connections closed for idle time or lifetime
+	Breaker        string `json:"breaker,omitempty"`
+}
+
+// PoolStatter is implemented by backends with a connection pool
+type PoolStatter interface {
+	PoolStats() PoolStats
+}
+
+// RetryPolicy is exponential backoff with full jitter
+type RetryPolicy struct {
+	Attempts int // total tries, 1 disables retries
+	Base     time.Duration
+	Max      time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: 4, Base: 500 * time.Millisecond, Max: 5 * time.Second}
+}
+
+// delay before retry number attempt, starting at 1
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Base << (attempt - 1)
+	if d > p.Max || d <= 0 {
+		d = p.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d) + 1
+}
+
+// Resilience decides how postgres calls are retried and when they fail fast
+type Resilience struct {
+	Retry   RetryPolicy
+	Breaker *Breaker // nil never trips
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// Breaker opens after threshold consecutive connection failures, after cooldown
+// a single call is let through and its result closes or reopens it
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow returns ErrCircuitOpen if the call must not reach postgres
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record reports the outcome of an allowed call, only connection failures count.
+// it returns true if err opened the breaker
+func (b *Breaker) Record(err error) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false // says nothing about postgres
+	}
+	if !retryable(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		opened := b.state != breakerOpen
+		b.state = breakerOpen
+		b.openedAt = b.now()
+		return opened
+	}
+	return false
+}
+
+// State is closed, open or half-open
+func (b *Breaker) State() string {
+	if b == nil {
+		return breakerClosed.String()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
+
+// retryable reports errors caused by the connection rather than the statement.
+// a network error after the statement was sent is not retryable, the statement may
+// have run and counter upserts must not run twice. the drivers report errors from
+// before sending as driver.ErrBadConn and SafeToRetry
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.AdminShutdown || pgErr.Code == pgerrcode.CannotConnectNow
+	}
+	return errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err)
+}
+
+// withRetry runs fn until it succeeds, fails with a non-connection error,
+// runs out of attempts or ctx is done, nil r uses the default policy
+func withRetry(ctx context.Context, r *Resilience, fn func() error) error {
+	policy := DefaultRetryPolicy()
+	var breaker *Breaker
+	if r != nil {
+		policy, breaker = r.Retry, r.Breaker
+	}
+
+	log, stats := logger.FromContext(ctx), selfstats.FromContext(ctx)
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err := breaker.Allow(); err != nil {
+			return err
+		}
+		err = fn()
+		if breaker.Record(err) {
+			stats.Inc("storage.postgres.breaker_open", 1)
+			log.Warn("postgres circuit breaker opened", zap.Error(err))
+		}
+		if !retryable(err) || attempt >= policy.Attempts {
+			return err
+		}
+
+		delay := policy.delay(attempt)
+		stats.Inc("storage.postgres.retries", 1)
+		log.Warn("postgres connection failed, retrying", zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
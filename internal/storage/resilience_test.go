@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// error of a driver that failed before sending anything
+type unsentError struct{}
+
+func (unsentError) Error() string     { return "dial failed" }
+func (unsentError) SafeToRetry() bool { return true }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// connection reset while reading the result of a sent statement
+var resetAfterSend = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"connection exception", &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, true},
+		{"admin shutdown", &pgconn.PgError{Code: pgerrcode.AdminShutdown}, true},
+		{"unique violation", &pgconn.PgError{Code: pgerrcode.UniqueViolation}, false},
+		{"statement timeout", &pgconn.PgError{Code: pgerrcode.QueryCanceled}, false},
+		{"bad conn", driver.ErrBadConn, true},
+		{"not sent", unsentError{}, true},
+		{"reset after send", resetAfterSend, false},
+		{"read timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, false},
+		{"canceled", context.Canceled, false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, retryable(tt.err))
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 10, Base: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	for attempt := 1; attempt < 10; attempt++ {
+		d := p.delay(attempt)
+		assert.Greater(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, min(p.Base<<(attempt-1), p.Max))
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Base: time.Millisecond, Max: time.Millisecond}
+	connErr := &pgconn.PgError{Code: pgerrcode.ConnectionFailure}
+
+	calls := 0
+	err := withRetry(context.Background(), &Resilience{Retry: policy}, func() error {
+		calls++
+		if calls < 3 {
+			return connErr
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// the statement may have run before the connection broke
+	calls = 0
+	err = withRetry(context.Background(), &Resilience{Retry: policy}, func() error {
+		calls++
+		return resetAfterSend
+	})
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, 1, calls)
+
+	// statement errors are not retried
+	calls = 0
+	err = withRetry(context.Background(), &Resilience{Retry: policy}, func() error {
+		calls++
+		return &pgconn.PgError{Code: pgerrcode.UniqueViolation}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+
+	// cancellation stops the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := &Resilience{Retry: RetryPolicy{Attempts: 5, Base: time.Hour, Max: time.Hour}}
+	done := make(chan error)
+	go func() {
+		done <- withRetry(ctx, slow, func() error { return connErr })
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("withRetry ignored cancellation")
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(2, time.Second)
+	b.now = func() time.Time { return now }
+	connErr := &pgconn.PgError{Code: pgerrcode.ConnectionFailure}
+
+	require.NoError(t, b.Allow())
+	b.Record(connErr)
+	assert.Equal(t, "closed", b.State())
+	require.NoError(t, b.Allow())
+	b.Record(connErr)
+	assert.Equal(t, "open", b.State())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen)
+
+	// one probe after the cooldown, a failed probe reopens
+	now = now.Add(time.Second)
+	require.NoError(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrCircuitOpen, "second call during the probe")
+	b.Record(connErr)
+	assert.Equal(t, "open", b.State())
+
+	// a successful probe closes, statement errors count as success
+	now = now.Add(time.Second)
+	require.NoError(t, b.Allow())
+	b.Record(&pgconn.PgError{Code: pgerrcode.UniqueViolation})
+	assert.Equal(t, "closed", b.State())
+	assert.NoError(t, b.Allow())
+
+	// fails fast without calling postgres
+	now = now.Add(time.Second)
+	b.Record(connErr)
+	b.Record(connErr)
+	calls := 0
+	err := withRetry(context.Background(), &Resilience{Retry: DefaultRetryPolicy(), Breaker: b}, func() error {
+		calls++
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Zero(t, calls)
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"go.uber.org/zap"
+)
+
+const (
+	snapshotFormat  = "metrics-snapshot"
+	snapshotVersion = 2
+
+	// header line is padded to this size so it can be filled in after the body is streamed
+	snapshotHeaderSize = 256
+
+	// snapshots kept for fallback by default: the current one and two previous
+	DefaultSnapshotKeep = 3
+)
+
+// ErrCorruptSnapshot is returned for snapshots that fail verification
+var ErrCorruptSnapshot = errors.New("corrupt snapshot")
+
+// SnapshotHeader is the first line of a snapshot file, the body follows on the next lines
+type SnapshotHeader struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Encoding string    `json:"encoding,omitempty"` // body codec, json if empty
+	Created  time.Time `json:"created"`
+	Count    int       `json:"count"`
+	Checksum string    `json:"checksum"`          // sha256 of the body
+	WALSeq   int64     `json:"wal_seq,omitempty"` // last wal record included
+}
+
+// path of the n-th previous snapshot, 0 is the current one
+func snapshotPath(filename string, n int) string {
+	if n == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s.%d", filename, n)
+}
+
+// writeSnapshot writes metrics to a temp file, fsyncs it and renames it over
+// filename, so readers see either the old or the new snapshot and never a partial one.
+// Previous snapshots are kept as filename.1 ... filename.<keep-1>
+func writeSnapshot(filename string, codec SnapshotCodec, metrics collector.Metrics, walSeq int64, keep int) (SnapshotHeader, error) {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	// no-op after successful rename
+	defer os.Remove(tmp.Name())
+
+	header, err := writeSnapshotBody(tmp, codec, metrics, walSeq)
+	if err != nil {
+		tmp.Close()
+		return header, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return header, err
+	}
+	if err := tmp.Close(); err != nil {
+		return header, err
+	}
+
+	if err := rotateSnapshots(filename, keep); err != nil {
+		return header, err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return header, err
+	}
+	return header, syncDir(dir)
+}
+
+// streams the body after a blank header line, then fills the header in
+func writeSnapshotBody(file *os.File, codec SnapshotCodec, metrics collector.Metrics, walSeq int64) (SnapshotHeader, error) {
+	var header SnapshotHeader
+	blank := append(bytes.Repeat([]byte(" "), snapshotHeaderSize-1), '\n')
+	if _, err := file.Write(blank); err != nil {
+		return header, err
+	}
+
+	sum := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(file, sum))
+	enc := codec.NewEncoder(w)
+	for _, metric := range metrics {
+		if err := enc.Encode(metric); err != nil {
+			return header, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return header, err
+	}
+	if err := w.Flush(); err != nil {
+		return header, err
+	}
+
+	header = SnapshotHeader{
+		Format:   snapshotFormat,
+		Version:  snapshotVersion,
+		Encoding: codec.Name(),
+		Created:  time.Now().UTC(),
+		Count:    len(metrics),
+		Checksum: hex.EncodeToString(sum.Sum(nil)),
+		WALSeq:   walSeq,
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return header, err
+	}
+	if len(line) >= snapshotHeaderSize {
+		return header, fmt.Errorf("snapshot header of %d bytes does not fit", len(line))
+	}
+	_, err = file.WriteAt(line, 0)
+	return header, err
+}
+
+// shifts previous snapshots by one, the current file stays in place
+// until it is atomically replaced
+func rotateSnapshots(filename string, keep int) error {
+	if keep <= 1 {
+		return nil
+	}
+	os.Remove(snapshotPath(filename, keep-1))
+	for n := keep - 2; n >= 1; n-- {
+		err := os.Rename(snapshotPath(filename, n), snapshotPath(filename, n+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// hard link keeps filename in place, fall back to copying where links are not supported
+	err := os.Link(filename, snapshotPath(filename, 1))
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return copyFile(filename, snapshotPath(filename, 1))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// makes rename durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// oldestSnapshotSeq returns the lowest wal seq of the previous snapshots kept
+// next to filename, or seq if there are none. unreadable ones are never restored and do not count
+func oldestSnapshotSeq(filename string, keep int, seq int64) int64 {
+	for n := 1; n < keep; n++ {
+		header, err := readSnapshotHeader(snapshotPath(filename, n))
+		if err == nil && header.WALSeq < seq {
+			seq = header.WALSeq
+		}
+	}
+	return seq
+}
+
+func readSnapshotHeader(filename string) (SnapshotHeader, error) {
+	var header SnapshotHeader
+	file, err := os.Open(filename)
+	if err != nil {
+		return header, err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return header, err
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, err
+	}
+	if header.Format != snapshotFormat {
+		return header, fmt.Errorf("%w: unknown format %q", ErrCorruptSnapshot, header.Format)
+	}
+	return header, nil
+}
+
+// readSnapshot verifies a single snapshot file and then passes its metrics to fn,
+// nothing is passed to fn if verification fails.
+// Files without a header are read as the old plain json format
+func readSnapshot(filename string, fn func(collector.Metric)) (SnapshotHeader, error) {
+	var header SnapshotHeader
+	file, err := os.Open(filename)
+	if err != nil {
+		return header, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return header, err
+	}
+	if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+		return header, nil
+	}
+	if json.Unmarshal(line, &header) != nil || header.Format != snapshotFormat {
+		return SnapshotHeader{}, readLegacySnapshot(filename, fn)
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return header, fmt.Errorf("%w: unsupported version %d", ErrCorruptSnapshot, header.Version)
+	}
+	encoding := header.Encoding
+	if encoding == "" {
+		encoding = "json"
+	}
+	codec, ok := codecs[encoding]
+	if !ok {
+		return header, fmt.Errorf("%w: unknown encoding %q", ErrCorruptSnapshot, encoding)
+	}
+
+	// first pass verifies the checksum and checks and counts the records, the second
+	// one streams them to fn. a corrupt file is never half applied and the snapshot
+	// is never held in memory as a whole
+	sum := sha256.New()
+	body := io.TeeReader(r, sum)
+	dec := codec.NewDecoder(bufio.NewReader(body))
+	count := 0
+	var invalid error
+	for {
+		metric, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = validSnapshotMetric(metric)
+		}
+		if err != nil {
+			invalid = err
+			break
+		}
+		count++
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return header, err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != header.Checksum {
+		return header, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+	if invalid != nil {
+		return header, fmt.Errorf("%w: %v", ErrCorruptSnapshot, invalid)
+	}
+	if count != header.Count {
+		return header, fmt.Errorf("%w: got %d metrics, header says %d", ErrCorruptSnapshot, count, header.Count)
+	}
+
+	if _, err := file.Seek(int64(len(line)), io.SeekStart); err != nil {
+		return header, err
+	}
+	dec = codec.NewDecoder(bufio.NewReader(file))
+	for {
+		metric, err := dec.Decode()
+		if err == io.EOF {
+			return header, nil
+		}
+		if err != nil {
+			return header, err
+		}
+		fn(metric)
+	}
+}
+
+// stream of json arrays written by the old ClearFile+Write
+func readLegacySnapshot(filename string, fn func(collector.Metric)) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	// checked in full before anything is applied, like readSnapshot does
+	apply := func(fn func(collector.Metric)) error {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var metrics collector.Metrics
+			if err := decoder.Decode(&metrics); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+			}
+			for _, metric := range metrics {
+				fn(metric)
+			}
+		}
+	}
+	var invalid error
+	err = apply(func(metric collector.Metric) {
+		if err := validSnapshotMetric(metric); err != nil && invalid == nil {
+			invalid = fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if invalid != nil {
+		return invalid
+	}
+	return apply(fn)
+}
+
+// readSnapshots streams the newest snapshot that passes verification to fn
+func readSnapshots(log *zap.Logger, filename string, keep int, fn func(collector.Metric)) (SnapshotHeader, error) {
+	if keep < 1 {
+		keep = 1
+	}
+	var errs []error
+	var missing error
+	for n := 0; n < keep; n++ {
+		path := snapshotPath(filename, n)
+		header, err := readSnapshot(path, fn)
+		if err == nil {
+			if n > 0 {
+				log.Warn("restored from previous snapshot", zap.String("path", path))
+			}
+			return header, nil
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			// no primary is the first boot, nothing to warn about
+			if n == 0 {
+				missing = err
+			}
+			continue
+		}
+		log.Error("snapshot skipped", zap.String("path", path), zap.Error(err))
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	if len(errs) == 0 {
+		return SnapshotHeader{}, missing
+	}
+	return SnapshotHeader{}, errors.Join(errs...)
+}
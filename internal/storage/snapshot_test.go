@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSnapshotWriteRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	s := NewMemStorage()
+	require.NoError(t, s.Update(ctx, "gauge", "Alloc", 1.5))
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(3)))
+	require.NoError(t, s.Write(file))
+
+	// no temp files left behind
+	entries, err := os.ReadDir(filepath.Dir(file))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.Restore(file))
+	assert.ElementsMatch(t, s.Snapshot(), restored.Snapshot())
+}
+
+func TestSnapshotFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, file string)
+	}{
+		{
+			name: "truncated",
+			corrupt: func(t *testing.T, file string) {
+				data, err := os.ReadFile(file)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(file, data[:len(data)-10], 0644))
+			},
+		},
+		{
+			name: "checksum mismatch",
+			corrupt: func(t *testing.T, file string) {
+				data, err := os.ReadFile(file)
+				require.NoError(t, err)
+				data[len(data)-5] ^= 1
+				require.NoError(t, os.WriteFile(file, data, 0644))
+			},
+		},
+		{
+			name: "count mismatch",
+			corrupt: func(t *testing.T, file string) {
+				data, err := os.ReadFile(file)
+				require.NoError(t, err)
+				data = bytes.Replace(data, []byte(`"count":1`), []byte(`"count":2`), 1)
+				require.NoError(t, os.WriteFile(file, data, 0644))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "metrics.json")
+			ctx := context.Background()
+
+			s := NewMemStorage()
+			require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+			require.NoError(t, s.Write(file))
+			require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+			require.NoError(t, s.Write(file))
+
+			_, err := readSnapshot(file, func(collector.Metric) {})
+			require.NoError(t, err)
+			tt.corrupt(t, file)
+			applied := 0
+			_, err = readSnapshot(file, func(collector.Metric) { applied++ })
+			assert.ErrorIs(t, err, ErrCorruptSnapshot)
+			assert.Zero(t, applied, "corrupt snapshot was partly applied")
+
+			// previous snapshot is used instead
+			restored := NewMemStorage()
+			require.NoError(t, restored.Restore(file))
+			m, err := restored.Return(ctx, "counter", "PollCount")
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), *m.Delta)
+		})
+	}
+}
+
+func TestSnapshotKeep(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	s := NewMemStorage()
+	s.SnapshotKeep = 2
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.Write(file))
+	}
+	assert.FileExists(t, file)
+	assert.FileExists(t, file+".1")
+	assert.NoFileExists(t, file+".2")
+}
+
+func TestSnapshotLegacy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	legacy := `[{"id":"Alloc","type":"gauge","value":2.5}]
+[{"id":"PollCount","type":"counter","delta":7}]
+`
+	require.NoError(t, os.WriteFile(file, []byte(legacy), 0644))
+
+	s := NewMemStorage()
+	require.NoError(t, s.Restore(file))
+	assert.Len(t, s.Snapshot(), 2)
+
+	// a record without its value is rejected instead of crashing restore
+	require.NoError(t, os.WriteFile(file, []byte(`[{"id":"x","type":"gauge"}]`), 0644))
+	assert.ErrorIs(t, NewMemStorage().Restore(file), ErrCorruptSnapshot)
+
+	// empty file written by a clean start means no metrics
+	require.NoError(t, os.WriteFile(file, nil, 0644))
+	assert.NoError(t, NewMemStorage().Restore(file))
+}
+
+func TestSnapshotFirstBoot(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := NewMemStorage()
+	s.Log = zap.New(core)
+	assert.ErrorIs(t, s.Restore(file), os.ErrNotExist)
+	assert.Zero(t, logs.Len(), "missing snapshot is not worth a log line")
+}
@@ -6,23 +6,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/jackc/pgerrcode"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/paranoiachains/metrics/internal/collector"
-	"github.com/paranoiachains/metrics/internal/flags"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/schema"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"go.uber.org/zap"
 )
 
-var retryDelays = []time.Duration{1, 3, 5}
-
-var Storage = NewMemStorage()
-
-// Depends on the flags used while running the program
-var CurrentStorage Database
+// time given to schema migrations on connect
+const migrateTimeout = time.Minute
 
 // flexibility
 type Database interface {
@@ -38,44 +35,78 @@ type FileHandler interface {
 	ClearFile(filename string) error
 }
 
-// function for determining whether to use memory storage or postgres
-func DetermineStorage() (Database, error) {
-	var s Database
-	if flags.DBEndpoint != "" {
-		databaseDSN := flags.DBEndpoint
-		db, err := ConnectAndPing("pgx", databaseDSN)
-		if err != nil {
-			return nil, err
-		}
-		s = db
-		fmt.Println("Using POSTGRESQL")
-	} else {
-		s = Storage
-		fmt.Println("Using MemStorage")
-	}
-	return s, nil
+// ----- MEMORY STORAGE -----
+
+// number of lock stripes, series are spread across them by name hash
+const defaultShards = 32
+
+type shard struct {
+	mu      sync.RWMutex
+	gauge   map[string]float64
+	counter map[string]int64
 }
 
-// ----- MEMORY STORAGE -----
+func newShard() *shard {
+	return &shard{
+		gauge:   make(map[string]float64),
+		counter: make(map[string]int64),
+	}
+}
 
-// store values (temporary choice)
+// concurrency-safe in-memory storage, series are sharded across
+// independently locked maps so parallel updates rarely contend
 type MemStorage struct {
-	Gauge   map[string]float64
-	Counter map[string]int64
+	shards       []*shard
+	Events       *Hub // optional, receives every change
+	SnapshotKeep int  // snapshots kept by Write, DefaultSnapshotKeep if 0
+	// restore and the wal report here, nil uses logger.Log and selfstats.Default
+	Log   *zap.Logger
+	Stats *selfstats.Registry
+	// codec name used by Write, chosen by file extension if empty.
+	// Restore reads any registered format
+	SnapshotFormat string
+
+	// updates hold it shared while logging and applying, Write takes it
+	// exclusively so a snapshot matches a wal position
+	walMu sync.RWMutex
+	wal   *WAL
 }
 
 // creates new memory storage
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		Gauge:   make(map[string]float64),
-		Counter: make(map[string]int64),
+	return NewShardedMemStorage(defaultShards)
+}
+
+// creates new memory storage with n lock stripes
+func NewShardedMemStorage(n int) *MemStorage {
+	if n <= 0 {
+		n = 1
+	}
+	s := &MemStorage{shards: make([]*shard, n)}
+	for i := range s.shards {
+		s.shards[i] = newShard()
+	}
+	return s
+}
+
+// fnv-1a
+func (s *MemStorage) shard(id string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
 	}
+	return s.shards[h%uint32(len(s.shards))]
 }
 
 // clears memory storage
 func (s *MemStorage) Clear() {
-	s.Gauge = make(map[string]float64)
-	s.Counter = make(map[string]int64)
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.gauge = make(map[string]float64)
+		sh.counter = make(map[string]int64)
+		sh.mu.Unlock()
+	}
 }
 
 // updates memory storage
@@ -83,21 +114,34 @@ func (s *MemStorage) Update(ctx context.Context, mtype string, id string, value
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	metric := collector.Metric{ID: id, MType: mtype}
 	switch mtype {
 	case "gauge":
 		v, ok := value.(float64)
 		if !ok {
 			return fmt.Errorf("type assertion error while updating memory storage")
 		}
-		s.Gauge[id] = v
-
+		metric.Value = &v
 	case "counter":
 		v, ok := value.(int64)
 		if !ok {
 			return fmt.Errorf("type assertion error while updating memory storage")
 		}
-		s.Counter[id] += v
+		metric.Delta = &v
+	default:
+		return nil
 	}
+
+	if s.wal == nil {
+		s.apply(metric)
+		return nil
+	}
+	s.walMu.RLock()
+	defer s.walMu.RUnlock()
+	if err := s.wal.Append(collector.Metrics{metric}); err != nil {
+		return err
+	}
+	s.apply(metric)
 	return nil
 }
 
@@ -105,32 +149,91 @@ func (s *MemStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics)
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	if s.wal == nil {
+		s.applyBatch(metrics)
+		return nil
+	}
+	// the whole batch is one record
+	s.walMu.RLock()
+	defer s.walMu.RUnlock()
+	if err := s.wal.Append(metrics); err != nil {
+		return err
+	}
+	s.applyBatch(metrics)
+	return nil
+}
+
+// apply adds a gauge or counter update, counters are accumulated
+func (s *MemStorage) apply(metric collector.Metric) {
+	sh := s.shard(metric.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	switch metric.MType {
+	case "gauge":
+		v := *metric.Value
+		sh.gauge[metric.ID] = v
+		// published under the lock so events of one series keep their order
+		if s.Events != nil {
+			s.Events.Publish(collector.Metric{ID: metric.ID, MType: metric.MType, Value: &v})
+		}
+	case "counter":
+		sh.counter[metric.ID] += *metric.Delta
+		if s.Events != nil {
+			total := sh.counter[metric.ID]
+			s.Events.Publish(collector.Metric{ID: metric.ID, MType: metric.MType, Delta: &total})
+		}
+	}
+}
+
+func (s *MemStorage) applyBatch(metrics collector.Metrics) {
 	for _, metric := range metrics {
-		switch metric.MType {
-		case "gauge":
-			s.Update(ctx, metric.MType, metric.ID, *metric.Value)
-		case "counter":
-			s.Update(ctx, metric.MType, metric.ID, *metric.Delta)
+		switch {
+		case metric.MType == "gauge" && metric.Value != nil:
+			s.apply(metric)
+		case metric.MType == "counter" && metric.Delta != nil:
+			s.apply(metric)
 		}
 	}
+}
+
+// OpenWAL logs every update to path before it is applied,
+// must be called before Restore so the log is replayed
+func (s *MemStorage) OpenWAL(path string, sync time.Duration) error {
+	wal, err := openWAL(path, sync, logger.Or(s.Log), selfstats.Or(s.Stats))
+	if err != nil {
+		return err
+	}
+	s.wal = wal
 	return nil
 }
 
+// Close closes the wal, if any
+func (s *MemStorage) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Close()
+}
+
 // retrieves value from memory storage
-func (s MemStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+func (s *MemStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
 	switch mtype {
 	case "gauge":
-		v, ok := s.Gauge[id]
+		v, ok := sh.gauge[id]
 		if !ok {
 			return nil, fmt.Errorf("no such gauge metric")
 		}
 		return &collector.Metric{ID: id, MType: mtype, Value: &v}, nil
 
 	case "counter":
-		v, ok := s.Counter[id]
+		v, ok := sh.counter[id]
 		if !ok {
 			return nil, fmt.Errorf("no such counter metric")
 		}
@@ -140,40 +243,57 @@ func (s MemStorage) Return(ctx context.Context, mtype string, id string) (*colle
 	return nil, fmt.Errorf("unknown metric type")
 }
 
-// writes to memory storage
-func (s MemStorage) Write(filename string) error {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
+// Snapshot returns every series, each shard is copied under its own lock
+func (s *MemStorage) Snapshot() collector.Metrics {
 	var metrics collector.Metrics
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	for name := range s.Gauge {
-		metric, err := s.Return(context.Background(), "gauge", name)
-		if err != nil {
-			return err
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for id, value := range sh.gauge {
+			v := value
+			metrics = append(metrics, collector.Metric{ID: id, MType: "gauge", Value: &v})
 		}
-		metrics = append(metrics, *metric)
+		for id, delta := range sh.counter {
+			d := delta
+			metrics = append(metrics, collector.Metric{ID: id, MType: "counter", Delta: &d})
+		}
+		sh.mu.RUnlock()
 	}
+	return metrics
+}
 
-	for name := range s.Counter {
-		metric, err := s.Return(context.Background(), "counter", name)
-		if err != nil {
-			return err
-		}
-		metrics = append(metrics, *metric)
+// writes a snapshot of memory storage, replacing the file atomically.
+// Wal records are dropped once every kept snapshot includes them, so restoring
+// from a previous snapshot still replays everything written after it
+func (s *MemStorage) Write(filename string) error {
+	codec, err := CodecFor(s.SnapshotFormat, filename)
+	if err != nil {
+		return err
 	}
-	if err := encoder.Encode(metrics); err != nil {
+	if s.wal == nil {
+		_, err := writeSnapshot(filename, codec, s.Snapshot(), 0, s.keep())
 		return err
 	}
-	return nil
+
+	s.walMu.Lock()
+	metrics := s.Snapshot()
+	pos := s.wal.position()
+	s.walMu.Unlock()
+
+	if _, err := writeSnapshot(filename, codec, metrics, pos.seq, s.keep()); err != nil {
+		return err
+	}
+	return s.wal.truncateTo(oldestSnapshotSeq(filename, s.keep(), pos.seq))
+}
+
+func (s *MemStorage) keep() int {
+	if s.SnapshotKeep <= 0 {
+		return DefaultSnapshotKeep
+	}
+	return s.SnapshotKeep
 }
 
 // FileHandler interface implementation of MemStorage type
-func (s MemStorage) Read(filename string) (*collector.Metric, error) {
+func (s *MemStorage) Read(filename string) (*collector.Metric, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -187,54 +307,151 @@ func (s MemStorage) Read(filename string) (*collector.Metric, error) {
 	return &metric, nil
 }
 
+// Restore loads the newest valid snapshot, falling back to previous ones,
+// and replays wal records written after it
 func (s *MemStorage) Restore(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
+	log := logger.Or(s.Log)
+	header, err := readSnapshots(log, filename, s.keep(), s.set)
+	if err != nil && (s.wal == nil || !errors.Is(err, os.ErrNotExist)) {
 		return err
 	}
-	defer file.Close()
+	if s.wal == nil {
+		return nil
+	}
 
-	decoder := json.NewDecoder(file)
-	for {
-		var metrics collector.Metrics
-		if err := decoder.Decode(&metrics); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		for _, metric := range metrics {
-			switch metric.MType {
-			case "gauge":
-				s.Gauge[metric.ID] = *metric.Value
-			case "counter":
-				s.Counter[metric.ID] = *metric.Delta
-			}
+	s.wal.advance(header.WALSeq)
+	replayed, err := s.wal.replay(header.WALSeq, func(rec walRecord) {
+		switch rec.Op {
+		case walUpdate:
+			s.applyBatch(rec.Metrics)
+		case walSet, walReplace:
+			s.load(rec.Metrics, rec.Op == walReplace)
+		case walTake:
+			s.take(rec.Metrics)
 		}
+	})
+	if replayed > 0 {
+		log.Info("replayed wal", zap.Int("records", replayed), zap.Int64("after_seq", header.WALSeq))
+	}
+	return err
+}
+
+// set overwrites series value, counters are not accumulated
+func (s *MemStorage) set(metric collector.Metric) {
+	sh := s.shard(metric.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	switch metric.MType {
+	case "gauge":
+		sh.gauge[metric.ID] = *metric.Value
+	case "counter":
+		sh.counter[metric.ID] = *metric.Delta
 	}
-	return nil
 }
 
 func (s *MemStorage) ClearFile(filename string) error {
-	if err := os.Truncate(filename, 0); err != nil {
+	if err := os.Truncate(filename, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 	return nil
 }
 
-func WriteWithInterval(file FileHandler, filename string, storeInterval int) {
-	// lol
-	if storeInterval == 0 {
-		storeInterval = 1
+// Flush writes current storage contents to file
+func Flush(file FileHandler, filename string) error {
+	return file.Write(filename)
+}
+
+// state of the file writer, reported by the readiness probe
+type PersistenceStatus struct {
+	mu        sync.Mutex
+	started   time.Time
+	interval  time.Duration
+	lastWrite time.Time
+	lastErr   error
+}
+
+func (p *PersistenceStatus) start(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started = time.Now()
+	p.interval = interval
+}
+
+func (p *PersistenceStatus) setInterval(interval time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.interval = interval
+}
+
+func (p *PersistenceStatus) record(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err == nil {
+		p.lastWrite = time.Now()
+	}
+}
+
+// Check fails if the last write failed or the writer stopped writing
+func (p *PersistenceStatus) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started.IsZero() {
+		return fmt.Errorf("file writer is not running")
+	}
+	if p.lastErr != nil {
+		return fmt.Errorf("last write failed: %w", p.lastErr)
+	}
+	last := p.lastWrite
+	if last.IsZero() {
+		last = p.started
+	}
+	// one missed interval is fine, the writer sleeps a second before the first write
+	if time.Since(last) > 2*p.interval+5*time.Second {
+		return fmt.Errorf("no successful write since %s", last.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Ping checks that the storage backend is reachable
+func Ping(ctx context.Context, db Database) error {
+	if p, ok := Unwrap(db).(interface{ PingContext(context.Context) error }); ok {
+		return p.PingContext(ctx)
+	}
+	return nil
+}
+
+// WriteWithInterval flushes storage to file until ctx is done,
+// interval is read before every write so it can change at runtime
+func WriteWithInterval(ctx context.Context, file FileHandler, filename string, interval func() int, status *PersistenceStatus) {
+	storeInterval := func() time.Duration {
+		// lol
+		if interval() == 0 {
+			return time.Second
+		}
+		return time.Duration(interval()) * time.Second
 	}
+	status.start(storeInterval())
 	// doesnt work without this line idk why
-	time.Sleep(time.Second)
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Second):
+	}
 	for {
-		file.ClearFile(filename)
-		if err := file.Write(filename); err != nil {
-			log.Fatal(err)
+		err := Flush(file, filename)
+		if err != nil {
+			logger.FromContext(ctx).Error("error while writing storage", zap.Error(err))
+		}
+		status.record(err)
+
+		next := storeInterval()
+		status.setInterval(next)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
 		}
-		time.Sleep(time.Duration(storeInterval) * time.Second)
 	}
 }
 
@@ -243,128 +460,151 @@ func WriteWithInterval(file FileHandler, filename string, storeInterval int) {
 // redeclaration for Database interface implementation
 type DBStorage struct {
 	*sql.DB
+	Events     *Hub        // optional, receives every change
+	Resilience *Resilience // nil retries with the default policy and never fails fast
 }
 
-func (db DBStorage) CreateIfNotExists(ctx context.Context) error {
-	createQuery := `
-	CREATE TABLE IF NOT EXISTS metrics (
-    id VARCHAR(255) PRIMARY KEY,
-    mtype VARCHAR(50) NOT NULL,
-    value DOUBLE PRECISION,
-    delta BIGINT
-);`
-	err := withRetry(func() error {
-		_, err := db.ExecContext(ctx, createQuery)
+// Migrate brings the schema up to date, replicas starting together apply migrations one at a time
+func (db DBStorage) Migrate(ctx context.Context) error {
+	return withRetry(ctx, db.Resilience, func() error {
+		applied, err := schema.New(db.DB).Up(ctx)
+		if len(applied) > 0 {
+			logger.FromContext(ctx).Info("applied schema migrations", zap.Int64s("versions", applied))
+		}
 		return err
 	})
-	if err != nil {
-		return err
-	}
-	return nil
 }
 
-func (db DBStorage) Update(ctx context.Context, mtype string, id string, value any) error {
-	insertQuery := `
+const gaugeUpsertQuery = `
 	INSERT INTO metrics (id, mtype, value, delta)
-	VALUES ($1, $2, $3, $4)
+	VALUES ($1, $2, $3, NULL)
 	ON CONFLICT (id) DO UPDATE
-		SET value = EXCLUDED.value, delta = EXCLUDED.delta;`
+		SET value = EXCLUDED.value, delta = NULL;`
 
-	counterDeltaQuery := `
-	SELECT delta FROM metrics
-	WHERE id=$1;
-	`
+// adds to the stored delta in one statement, the row lock taken by
+// ON CONFLICT serializes concurrent increments of the same counter
+const counterUpsertQuery = `
+	INSERT INTO metrics (id, mtype, value, delta)
+	VALUES ($1, $2, NULL, $3)
+	ON CONFLICT (id) DO UPDATE
+		SET value = NULL, delta = COALESCE(metrics.delta, 0) + EXCLUDED.delta
+	RETURNING delta;`
 
+func (db DBStorage) Update(ctx context.Context, mtype string, id string, value any) error {
 	switch mtype {
 	case "gauge":
 		v, ok := value.(float64)
 		if !ok {
 			return fmt.Errorf("type assertion error while updating database")
 		}
-		return withRetry(func() error {
-			_, err := db.ExecContext(ctx, insertQuery, id, mtype, v, nil)
+		err := withRetry(ctx, db.Resilience, func() error {
+			_, err := db.ExecContext(ctx, gaugeUpsertQuery, id, mtype, v)
 			return err
 		})
+		if err != nil {
+			return err
+		}
+		db.Events.Publish(collector.Metric{ID: id, MType: mtype, Value: &v})
+		return nil
 
 	case "counter":
 		v, ok := value.(int64)
 		if !ok {
 			return fmt.Errorf("type assertion error while updating database")
 		}
-		return withRetry(func() error {
-			var currentDelta sql.NullInt64
-			row := db.QueryRowContext(ctx, counterDeltaQuery, id)
-			err := row.Scan(&currentDelta)
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-			newDelta := v
-			if currentDelta.Valid {
-				newDelta += currentDelta.Int64
-			}
-			_, err = db.ExecContext(ctx, insertQuery, id, mtype, nil, newDelta)
-			return err
+		var total int64
+		err := withRetry(ctx, db.Resilience, func() error {
+			return db.QueryRowContext(ctx, counterUpsertQuery, id, mtype, v).Scan(&total)
 		})
+		if err != nil {
+			return err
+		}
+		db.Events.Publish(collector.Metric{ID: id, MType: mtype, Delta: &total})
+		return nil
 	default:
 		return fmt.Errorf("unknown metric type: %s", mtype)
 	}
 }
 
 func (db DBStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
-	insertQuery := `
-	INSERT INTO metrics (id, mtype, value, delta)
-	VALUES ($1, $2, $3, $4)
-	ON CONFLICT (id) DO UPDATE
-		SET value = EXCLUDED.value, delta = EXCLUDED.delta;`
-	counterDeltaQuery := `
-	SELECT delta FROM metrics
-	WHERE id=$1;
-	`
+	merged, err := mergeBatch(metrics)
+	if err != nil {
+		return err
+	}
 
-	return withRetry(func() error {
+	var changed collector.Metrics
+	err = withRetry(ctx, db.Resilience, func() error {
+		changed = changed[:0]
 		tx, err := db.BeginTx(ctx, nil)
 		if err != nil {
 			return err
 		}
+		defer tx.Rollback()
 
-		stmt, err := tx.PrepareContext(ctx, insertQuery)
+		gaugeStmt, err := tx.PrepareContext(ctx, gaugeUpsertQuery)
+		if err != nil {
+			return err
+		}
+		defer gaugeStmt.Close()
+		counterStmt, err := tx.PrepareContext(ctx, counterUpsertQuery)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
-		defer stmt.Close()
+		defer counterStmt.Close()
 
-		for _, metric := range metrics {
+		for _, metric := range merged {
 			switch metric.MType {
 			case "gauge":
-				if _, err := stmt.ExecContext(ctx, metric.ID, metric.MType, *metric.Value, nil); err != nil {
-					tx.Rollback()
+				if _, err := gaugeStmt.ExecContext(ctx, metric.ID, metric.MType, *metric.Value); err != nil {
 					return err
 				}
+				changed = append(changed, metric)
 			case "counter":
-				var currentDelta sql.NullInt64
-				row := tx.QueryRowContext(ctx, counterDeltaQuery, metric.ID)
-				err := row.Scan(&currentDelta)
-				if err != nil && err != sql.ErrNoRows {
-					tx.Rollback()
+				var total int64
+				if err := counterStmt.QueryRowContext(ctx, metric.ID, metric.MType, *metric.Delta).Scan(&total); err != nil {
 					return err
 				}
-				newDelta := *metric.Delta
-				if currentDelta.Valid {
-					newDelta += currentDelta.Int64
-				}
-				if _, err := stmt.ExecContext(ctx, metric.ID, metric.MType, nil, newDelta); err != nil {
-					tx.Rollback()
-					return err
-				}
-			default:
-				tx.Rollback()
-				return fmt.Errorf("unknown metric type: %s", metric.MType)
+				changed = append(changed, collector.Metric{ID: metric.ID, MType: metric.MType, Delta: &total})
 			}
 		}
 
 		return tx.Commit()
 	})
+	if err != nil {
+		return err
+	}
+	db.Events.Publish(changed...)
+	return nil
+}
+
+// mergeBatch sums repeated counters and keeps the last value of repeated gauges,
+// rows are sorted by id so concurrent batches lock them in the same order and cannot deadlock
+func mergeBatch(metrics collector.Metrics) (collector.Metrics, error) {
+	byID := make(map[string]int, len(metrics))
+	merged := make(collector.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		switch {
+		case metric.MType == "gauge" && metric.Value != nil:
+		case metric.MType == "counter" && metric.Delta != nil:
+		default:
+			return nil, fmt.Errorf("invalid metric %q of type %q", metric.ID, metric.MType)
+		}
+
+		i, ok := byID[metric.ID]
+		if !ok || merged[i].MType != metric.MType {
+			byID[metric.ID] = len(merged)
+			merged = append(merged, metric)
+			continue
+		}
+		if metric.MType == "gauge" {
+			merged[i].Value = metric.Value
+			continue
+		}
+		sum := *merged[i].Delta + *metric.Delta
+		merged[i].Delta = &sum
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].ID < merged[j].ID })
+	return merged, nil
 }
 
 func (db DBStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
@@ -374,53 +614,78 @@ func (db DBStorage) Return(ctx context.Context, mtype string, id string) (*colle
 	WHERE id=$1 AND mtype=$2;`
 
 	var metric collector.Metric
-	err := withRetry(func() error {
+	err := withRetry(ctx, db.Resilience, func() error {
 		row := db.QueryRowContext(ctx, selectQuery, id, mtype)
 		return row.Scan(&metric.ID, &metric.MType, &metric.Value, &metric.Delta)
 	})
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("Successfully returned value from table metrics")
 	return &metric, nil
 }
 
 func ConnectAndPing(driverName string, dataSourceName string) (*DBStorage, error) {
+	return Connect(driverName, dataSourceName, PoolConfig{})
+}
+
+// Connect opens a database/sql pool configured by pool, pings it and applies schema migrations
+func Connect(driverName string, dataSourceName string, pool PoolConfig) (*DBStorage, error) {
+	return connect(context.Background(), driverName, dataSourceName, pool)
+}
+
+// connect is Connect reporting through the logger and stats of parent
+func connect(parent context.Context, driverName string, dataSourceName string, pool PoolConfig) (*DBStorage, error) {
+	pool = pool.withDefaults()
+	if driverName == "pgx" {
+		name, err := registerConnConfig(dataSourceName, pool)
+		if err != nil {
+			return nil, err
+		}
+		dataSourceName = name
+	}
 	db, err := sql.Open(driverName, dataSourceName)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(parent, 2*time.Second)
 	defer cancel()
 	if err := db.PingContext(ctx); err != nil {
+		db.Close()
 		return nil, err
 	}
-	fmt.Println("Successfully connected to db")
-
-	newDB := &DBStorage{db}
-	if err := newDB.CreateIfNotExists(ctx); err != nil {
+	logger.FromContext(parent).Debug("connected to postgres")
+
+	// other replicas may hold the migration lock for a while
+	migrateCtx, cancelMigrate := context.WithTimeout(parent, migrateTimeout)
+	defer cancelMigrate()
+	newDB := &DBStorage{DB: db, Resilience: pool.resilience()}
+	if err := newDB.Migrate(migrateCtx); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return newDB, nil
 }
 
-func withRetry(fn func() error) error {
-	var lastErr error
-	for _, delay := range retryDelays {
-		err := fn()
-		if err == nil {
-			return nil
-		}
-		lastErr = err
-
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-			fmt.Printf("DB connection failed, retrying in %v...\n", delay*time.Second)
-			time.Sleep(delay * time.Second)
-			continue
-		}
-		return err // не retriable
+// PoolStats reports the database/sql pool and breaker state
+func (db DBStorage) PoolStats() PoolStats {
+	st := db.Stats()
+	stats := PoolStats{
+		Driver:         "sql",
+		MaxOpen:        st.MaxOpenConnections,
+		Open:           st.OpenConnections,
+		InUse:          st.InUse,
+		Idle:           st.Idle,
+		WaitCount:      st.WaitCount,
+		WaitDurationMs: st.WaitDuration.Milliseconds(),
+		Closed:         st.MaxIdleClosed + st.MaxIdleTimeClosed + st.MaxLifetimeClosed,
+	}
+	if db.Resilience != nil {
+		stats.Breaker = db.Resilience.Breaker.State()
 	}
-	return lastErr
+	return stats
 }
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStorageConcurrentUpdates(t *testing.T) {
+	s := NewMemStorage()
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	const workers = 8
+	const updates = 1000
+
+	// require must not be called outside the test goroutine, workers report here
+	errs := make(chan error, workers*updates*2+20)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				errs <- s.Update(ctx, "counter", "requests", int64(1))
+				errs <- s.Update(ctx, "gauge", fmt.Sprintf("g%d", i%50), float64(w))
+			}
+		}(w)
+	}
+
+	// file writer runs concurrently with handlers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			errs <- Flush(s, file)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	m, err := s.Return(ctx, "counter", "requests")
+	require.NoError(t, err)
+	assert.Equal(t, int64(workers*updates), *m.Delta)
+	assert.Len(t, s.Snapshot(), 51)
+
+	// last flush reflects the final state
+	require.NoError(t, Flush(s, file))
+	restored := NewMemStorage()
+	require.NoError(t, restored.Restore(file))
+	assert.ElementsMatch(t, s.Snapshot(), restored.Snapshot())
+}
+
+func benchmarkUpdates(b *testing.B, shards int) {
+	s := NewShardedMemStorage(shards)
+	ctx := context.Background()
+	ids := make([]string, 1024)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("metric_%d", i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			id := ids[i%len(ids)]
+			if i%2 == 0 {
+				s.Update(ctx, "gauge", id, float64(i))
+			} else {
+				s.Update(ctx, "counter", id, int64(1))
+			}
+			i++
+		}
+	})
+}
+
+// go test -bench MemStorage -cpu 1,2,4,8 ./internal/storage/
+func BenchmarkMemStorageUpdate(b *testing.B) {
+	for _, shards := range []int{1, 8, defaultShards, 128} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkUpdates(b, shards)
+		})
+	}
+}
+
+func BenchmarkMemStorageBatch(b *testing.B) {
+	s := NewMemStorage()
+	ctx := context.Background()
+	batch := make(collector.Metrics, 100)
+	for i := range batch {
+		v := float64(i)
+		batch[i] = collector.Metric{ID: fmt.Sprintf("metric_%d", i), MType: "gauge", Value: &v}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.UpdateBatch(ctx, batch)
+		}
+	})
+}
+
+func BenchmarkMemStorageReturn(b *testing.B) {
+	s := NewMemStorage()
+	ctx := context.Background()
+	for i := 0; i < 1024; i++ {
+		s.Update(ctx, "gauge", fmt.Sprintf("metric_%d", i), float64(i))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.Return(ctx, "gauge", fmt.Sprintf("metric_%d", i%1024))
+			i++
+		}
+	})
+}
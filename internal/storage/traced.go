@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation scope of storage spans
+const tracerName = "github.com/paranoiachains/metrics/internal/storage"
+
+// TracedStorage starts a client span for every operation, children of the span in ctx
+type TracedStorage struct {
+	Database
+	tracer trace.Tracer
+}
+
+func NewTracedStorage(db Database, tp trace.TracerProvider) *TracedStorage {
+	return &TracedStorage{Database: db, tracer: tp.Tracer(tracerName)}
+}
+
+func (s *TracedStorage) Unwrap() Database {
+	return s.Database
+}
+
+func (s *TracedStorage) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "storage."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *TracedStorage) Update(ctx context.Context, mtype string, id string, value any) error {
+	ctx, span := s.start(ctx, "update", attribute.String("metric.type", mtype), attribute.String("metric.id", id))
+	err := s.Database.Update(ctx, mtype, id, value)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) UpdateBatch(ctx context.Context, metrics collector.Metrics) error {
+	ctx, span := s.start(ctx, "update_batch", attribute.Int("batch.size", len(metrics)))
+	err := s.Database.UpdateBatch(ctx, metrics)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) Return(ctx context.Context, mtype string, id string) (*collector.Metric, error) {
+	ctx, span := s.start(ctx, "return", attribute.String("metric.type", mtype), attribute.String("metric.id", id))
+	m, err := s.Database.Return(ctx, mtype, id)
+	end(span, err)
+	return m, err
+}
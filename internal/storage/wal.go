@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/paranoiachains/metrics/internal/logger"
+	"github.com/paranoiachains/metrics/internal/selfstats"
+	"go.uber.org/zap"
+)
+
+// record layout: 4 byte payload length, 4 byte crc32c of payload, json payload
+const walHeaderSize = 8
+
+// records larger than that are treated as corruption
+const walMaxRecord = 64 << 20
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptWAL is returned for log records that fail verification
+var ErrCorruptWAL = errors.New("corrupt wal")
+
+// record ops
+const (
+	walUpdate  = ""        // gauges are set, counters accumulated
+	walSet     = "set"     // values overwrite the series
+	walReplace = "replace" // storage is cleared, then values are set
+	walTake    = "take"    // exported values are taken out, see Taker
+)
+
+type walRecord struct {
+	Seq     int64             `json:"seq"`
+	Op      string            `json:"op,omitempty"`
+	Metrics collector.Metrics `json:"metrics"`
+	size    int64             // bytes in the log, header included
+}
+
+// position in the log, everything up to and including seq ends at offset
+type walPosition struct {
+	seq    int64
+	offset int64
+}
+
+// WAL is an append-only log of updates not yet covered by a snapshot.
+// Records are written to the file before Append returns, so they survive a process crash.
+// With a zero sync interval every record is fsynced, otherwise fsyncs are batched
+// and a machine crash may lose up to one interval of updates
+type WAL struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	pos    walPosition
+	dirty  bool
+	buf    []byte
+	sync   time.Duration
+	done   chan struct{}
+	closed sync.WaitGroup
+	log    *zap.Logger
+	stats  *selfstats.Registry
+}
+
+// OpenWAL opens or creates the log at path, a torn record at the end left by a crash is cut off
+func OpenWAL(path string, sync time.Duration) (*WAL, error) {
+	return openWAL(path, sync, logger.Log, selfstats.Default)
+}
+
+func openWAL(path string, sync time.Duration, log *zap.Logger, stats *selfstats.Registry) (*WAL, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		os.MkdirAll(dir, 0755)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pos, err := scanWAL(file, func(walRecord) {})
+	if err != nil {
+		log.Warn("wal: dropping torn tail", zap.String("path", path), zap.Int64("offset", pos.offset), zap.Error(err))
+		if err := file.Truncate(pos.offset); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	w := &WAL{
+		path:  path,
+		file:  file,
+		pos:   pos,
+		sync:  sync,
+		done:  make(chan struct{}),
+		log:   log,
+		stats: stats,
+	}
+	if sync > 0 {
+		w.closed.Add(1)
+		go w.syncWithInterval()
+	}
+	return w, nil
+}
+
+// Append logs metrics as one update record
+func (w *WAL) Append(metrics collector.Metrics) error {
+	return w.append(walUpdate, metrics)
+}
+
+func (w *WAL) append(op string, metrics collector.Metrics) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+
+	payload, err := json.Marshal(walRecord{Seq: w.pos.seq + 1, Op: op, Metrics: metrics})
+	if err != nil {
+		return err
+	}
+	w.buf = binary.LittleEndian.AppendUint32(w.buf[:0], uint32(len(payload)))
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, crc32.Checksum(payload, walTable))
+	w.buf = append(w.buf, payload...)
+
+	// single write so a crash leaves at most one torn record
+	if _, err := w.file.Write(w.buf); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	w.pos.seq++
+	w.pos.offset += int64(len(w.buf))
+	w.dirty = true
+
+	if w.sync == 0 {
+		return w.syncLocked()
+	}
+	return nil
+}
+
+func (w *WAL) syncLocked() error {
+	if !w.dirty {
+		return nil
+	}
+	start := time.Now()
+	if err := w.file.Sync(); err != nil {
+		w.stats.Inc("storage.wal.sync_errors", 1)
+		return fmt.Errorf("wal: %w", err)
+	}
+	w.stats.Observe("storage.wal.sync", time.Since(start))
+	w.dirty = false
+	return nil
+}
+
+func (w *WAL) syncWithInterval() {
+	defer w.closed.Done()
+	ticker := time.NewTicker(w.sync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.file != nil {
+				if err := w.syncLocked(); err != nil {
+					w.log.Error("error while syncing wal", zap.Error(err))
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// position of the last appended record
+func (w *WAL) position() walPosition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pos
+}
+
+// sequence numbers continue after the ones covered by a restored snapshot
+func (w *WAL) advance(seq int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq > w.pos.seq {
+		w.pos.seq = seq
+	}
+}
+
+// truncate drops records up to pos once they are covered by a snapshot,
+// records appended after pos are kept
+func (w *WAL) truncate(pos walPosition) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+	return w.truncateLocked(pos)
+}
+
+// truncateTo drops records up to and including seq
+func (w *WAL) truncateTo(seq int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+	var pos walPosition
+	_, err := scanWAL(w.file, func(rec walRecord) {
+		if rec.Seq <= seq {
+			pos.seq = rec.Seq
+			pos.offset += rec.size
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if pos.offset == 0 {
+		return nil
+	}
+	return w.truncateLocked(pos)
+}
+
+func (w *WAL) truncateLocked(pos walPosition) error {
+	if pos.offset == w.pos.offset {
+		if err := w.file.Truncate(0); err != nil {
+			return err
+		}
+		w.pos.offset = 0
+		w.dirty = true
+		return w.syncLocked()
+	}
+
+	// copy the tail to a new file and swap it in
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, io.NewSectionReader(w.file, pos.offset, w.pos.offset-pos.offset)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.pos.offset -= pos.offset
+	w.dirty = false
+	return syncDir(filepath.Dir(w.path))
+}
+
+// replay calls apply for every record after seq. records missing right after seq,
+// e.g. dropped once a newer snapshot covered them, are reported after the rest is applied
+func (w *WAL) replay(seq int64, apply func(walRecord)) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	replayed := 0
+	var first int64
+	_, err := scanWAL(w.file, func(rec walRecord) {
+		if rec.Seq > seq {
+			if replayed == 0 {
+				first = rec.Seq
+			}
+			apply(rec)
+			replayed++
+		}
+	})
+	if err == nil && first > seq+1 {
+		err = fmt.Errorf("%w: records %d to %d after the snapshot are missing", ErrCorruptWAL, seq+1, first-1)
+	}
+	return replayed, err
+}
+
+// Close syncs and closes the log
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.file == nil {
+		w.mu.Unlock()
+		return nil
+	}
+	close(w.done)
+	err := w.syncLocked()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file = nil
+	w.mu.Unlock()
+
+	w.closed.Wait()
+	return err
+}
+
+// scanWAL reads records from the start of file, returning position of the last valid one.
+// An error means the log has garbage after that position
+func scanWAL(file *os.File, fn func(walRecord)) (walPosition, error) {
+	var pos walPosition
+	r := bufio.NewReader(io.NewSectionReader(file, 0, 1<<62))
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return pos, nil
+			}
+			return pos, fmt.Errorf("%w: torn record header", ErrCorruptWAL)
+		}
+		size := binary.LittleEndian.Uint32(header[:4])
+		if size > walMaxRecord {
+			return pos, fmt.Errorf("%w: record of %d bytes", ErrCorruptWAL, size)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return pos, fmt.Errorf("%w: torn record", ErrCorruptWAL)
+		}
+		if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:]) {
+			return pos, fmt.Errorf("%w: record checksum mismatch", ErrCorruptWAL)
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return pos, fmt.Errorf("%w: %v", ErrCorruptWAL, err)
+		}
+		rec.size = int64(walHeaderSize + len(payload))
+		fn(rec)
+		pos.seq = rec.Seq
+		pos.offset += rec.size
+	}
+}
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paranoiachains/metrics/internal/collector"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openWithWAL(t *testing.T, file string) *MemStorage {
+	s := NewMemStorage()
+	require.NoError(t, s.OpenWAL(file+".wal", 0))
+	t.Cleanup(func() { s.Close() })
+	require.NoError(t, s.Restore(file))
+	return s
+}
+
+func counter(t *testing.T, s *MemStorage, id string) int64 {
+	m, err := s.Return(context.Background(), "counter", id)
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func TestWALReplay(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+	delta := int64(5)
+	value := 1.5
+
+	s := openWithWAL(t, file)
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Write(file))
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(2)))
+	require.NoError(t, s.UpdateBatch(ctx, collector.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "Alloc", MType: "gauge", Value: &value},
+	}))
+	// crash: no final snapshot
+	require.NoError(t, s.Close())
+
+	restored := openWithWAL(t, file)
+	assert.Equal(t, int64(8), counter(t, restored, "PollCount"))
+	assert.Len(t, restored.Snapshot(), 2)
+
+	// snapshot covers the log, nothing is applied twice.
+	// with no previous snapshots kept the whole log is dropped
+	restored.SnapshotKeep = 1
+	require.NoError(t, restored.Write(file))
+	info, err := os.Stat(file + ".wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	require.NoError(t, restored.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, restored.Close())
+
+	again := openWithWAL(t, file)
+	assert.Equal(t, int64(9), counter(t, again, "PollCount"))
+}
+
+func TestWALTornTail(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	s := openWithWAL(t, file)
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Close())
+
+	// half-written last record
+	info, err := os.Stat(file + ".wal")
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(file+".wal", info.Size()-3))
+
+	restored := openWithWAL(t, file)
+	assert.Equal(t, int64(1), counter(t, restored, "PollCount"))
+
+	// appends continue after the cut
+	require.NoError(t, restored.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, restored.Close())
+	assert.Equal(t, int64(2), counter(t, openWithWAL(t, file), "PollCount"))
+}
+
+func TestWALTruncateKeepsNewerRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	w, err := OpenWAL(path, 0)
+	require.NoError(t, err)
+	defer w.Close()
+
+	one := int64(1)
+	record := collector.Metrics{{ID: "c", MType: "counter", Delta: &one}}
+	require.NoError(t, w.Append(record))
+	pos := w.position()
+	require.NoError(t, w.Append(record))
+	require.NoError(t, w.Append(record))
+	require.NoError(t, w.truncate(pos))
+
+	replayed, err := w.replay(pos.seq, func(walRecord) {})
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, int64(3), w.position().seq)
+
+	// a snapshot older than the log cannot be brought up to date
+	replayed, err = w.replay(0, func(walRecord) {})
+	assert.ErrorIs(t, err, ErrCorruptWAL)
+	assert.Equal(t, 2, replayed)
+}
+
+func TestWALKeptForPreviousSnapshots(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	s := openWithWAL(t, file)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+		require.NoError(t, s.Write(file))
+	}
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Close())
+
+	// the newest snapshot is unreadable, the previous one and the log make up for it
+	require.NoError(t, os.WriteFile(file, []byte("garbage"), 0644))
+	restored := openWithWAL(t, file)
+	assert.Equal(t, int64(5), counter(t, restored, "PollCount"))
+}
+
+func TestWALGapIsReported(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	s := openWithWAL(t, file)
+	s.SnapshotKeep = 1
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Write(file))
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Close())
+
+	// a snapshot from before the records the log dropped
+	codec, err := CodecFor("json", file)
+	require.NoError(t, err)
+	_, err = writeSnapshot(file, codec, nil, 0, 1)
+	require.NoError(t, err)
+
+	restored := NewMemStorage()
+	require.NoError(t, restored.OpenWAL(file+".wal", 0))
+	defer restored.Close()
+	assert.ErrorIs(t, restored.Restore(file), ErrCorruptWAL)
+	assert.Equal(t, int64(1), counter(t, restored, "PollCount"), "what is left is still replayed")
+}
+
+func TestWALReplaysImport(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+	delta := int64(10)
+
+	s := openWithWAL(t, file)
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Update(ctx, "counter", "Other", int64(1)))
+	require.NoError(t, s.Import(ctx, collector.Metrics{{ID: "PollCount", MType: "counter", Delta: &delta}}, true))
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Close())
+
+	restored := openWithWAL(t, file)
+	assert.Equal(t, int64(11), counter(t, restored, "PollCount"))
+	_, err := restored.Return(ctx, "counter", "Other")
+	assert.Error(t, err)
+}
+
+func TestWALReplaysTake(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	ctx := context.Background()
+
+	s := openWithWAL(t, file)
+	require.NoError(t, s.Update(ctx, "counter", "PollCount", int64(1)))
+	require.NoError(t, s.Update(ctx, "counter", "Moved", int64(1)))
+	require.NoError(t, s.Update(ctx, "counter", "Partly", int64(5)))
+	one, two := int64(1), int64(2)
+	require.NoError(t, s.Take(ctx, collector.Metrics{
+		{ID: "Moved", MType: "counter", Delta: &one},
+		{ID: "Partly", MType: "counter", Delta: &two},
+	}))
+	_, err := s.Return(ctx, "counter", "Moved")
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+
+	restored := openWithWAL(t, file)
+	assert.Equal(t, int64(1), counter(t, restored, "PollCount"))
+	assert.Equal(t, int64(3), counter(t, restored, "Partly"))
+	_, err = restored.Return(ctx, "counter", "Moved")
+	assert.Error(t, err)
+}